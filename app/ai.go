@@ -44,21 +44,21 @@ func aiInit() (err error) {
 		}
 	}
 
-	if _, err := aiEmbeddings("test"); err != nil {
+	if _, err := aiEmbeddings(context.Background(), "test"); err != nil {
 		return fmt.Errorf("AI error loading embedding model: %v", err)
 	}
 
 	return nil
 }
 
-func aiEmbeddings(input string) ([]float32, error) {
+func aiEmbeddings(ctx context.Context, input string) ([]float32, error) {
 	if options.aiApi {
-		return aiApiEmbeddings(input)
+		return aiApiEmbeddings(ctx, input)
 	}
-	return localAiEmbeddings(input)
+	return localAiEmbeddings(ctx, input)
 }
 
-func aiApiEmbeddings(input string) (output []float32, err error) {
+func aiApiEmbeddings(ctx context.Context, input string) (output []float32, err error) {
 	url := options.aiApiUrl
 	payload := aiEmbeddingRequest{
 		Model:          options.aiModel,
@@ -71,7 +71,7 @@ func aiApiEmbeddings(input string) (output []float32, err error) {
 		return nil, fmt.Errorf("failed to marshal embedding request: %v", err)
 	}
 
-	req, err := http.NewRequestWithContext(context.TODO(), "POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
@@ -107,7 +107,7 @@ func aiApiEmbeddings(input string) (output []float32, err error) {
 	return apiResp.Data[0].Embedding, nil
 }
 
-func aiApiEmbeddingsBatch(inputs []string) ([][]float32, error) {
+func aiApiEmbeddingsBatch(ctx context.Context, inputs []string) ([][]float32, error) {
 	url := options.aiApiUrl
 	payload := aiEmbeddingRequest{
 		Model:          options.aiModel,
@@ -120,7 +120,7 @@ func aiApiEmbeddingsBatch(inputs []string) ([][]float32, error) {
 		return nil, fmt.Errorf("failed to marshal batch request: %v", err)
 	}
 
-	req, err := http.NewRequestWithContext(context.TODO(), "POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
@@ -230,7 +230,7 @@ func localAiInit(modelPath string) error {
 	return nil
 }
 
-func localAiEmbeddings(input string) ([]float32, error) {
+func localAiEmbeddings(ctx context.Context, input string) ([]float32, error) {
 	globalMu.Lock()
 	defer globalMu.Unlock()
 
@@ -286,7 +286,7 @@ func localAiEmbeddings(input string) ([]float32, error) {
 
 		globalMdl.parser.r = NewBufferedReadSeeker(r, 256*1024)
 
-		emb, err := globalMdl.embed(ids)
+		emb, err := globalMdl.embed(ctx, ids)
 
 		if closeFn != nil {
 			closeFn()
@@ -297,6 +297,6 @@ func localAiEmbeddings(input string) ([]float32, error) {
 		return emb, err
 	}
 
-	emb, err := globalMdl.embed(ids)
+	emb, err := globalMdl.embed(ctx, ids)
 	return emb, err
 }
@@ -0,0 +1,114 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// aiTokenizer returns the tokenizer of the embedding model, read from the
+// GGUF when the embeddings come from an API, or nil when no GGUF is
+// available.
+func aiTokenizer() *bpeTokenizer {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	if globalTok != nil {
+		return globalTok
+	}
+
+	r, closeFn, err := openGGUFStream()
+	if err != nil {
+		return nil
+	}
+	if closeFn != nil {
+		defer closeFn()
+	}
+
+	p, err := NewGGUFParser(NewBufferedReadSeeker(r, 256*1024))
+	if err != nil {
+		return nil
+	}
+	tok, err := loadTokenizer(p)
+	if err != nil {
+		return nil
+	}
+
+	globalTok = tok
+	return tok
+}
+
+// aiChunks splits text into passages of at most size tokens, each one
+// starting overlap tokens before the end of the previous one. The passages
+// are byte ranges cut between words, or between the characters of scripts
+// written without spaces, so a single word longer than size is never split.
+// Without a tokenizer the tokens are estimated as four bytes each.
+func aiChunks(tok *bpeTokenizer, text string, size int, overlap int) [][2]int {
+	type piece struct {
+		start, end int
+		tokens     int
+	}
+
+	counts := make(map[string]int)
+	count := func(word string) int {
+		if tokens, ok := counts[word]; ok {
+			return tokens
+		}
+		tokens := (len(word) + 4) / 4
+		if tok != nil {
+			tokens = len(tok.bpeSegment(" " + word))
+		}
+		counts[word] = tokens
+		return tokens
+	}
+
+	var pieces []piece
+	start := -1
+	flush := func(end int) {
+		if start >= 0 {
+			pieces = append(pieces, piece{start: start, end: end, tokens: count(text[start:end])})
+		}
+		start = -1
+	}
+	for i, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			flush(i)
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai):
+			flush(i)
+			start = i
+			flush(i + utf8.RuneLen(r))
+		case start < 0:
+			start = i
+		}
+	}
+	flush(len(text))
+
+	if len(pieces) == 0 {
+		return nil
+	}
+
+	var chunks [][2]int
+	first := 0
+	for {
+		last, tokens := first, pieces[first].tokens
+		for last+1 < len(pieces) && tokens+pieces[last+1].tokens <= size {
+			last++
+			tokens += pieces[last].tokens
+		}
+		chunks = append(chunks, [2]int{pieces[first].start, pieces[last].end})
+		if last+1 == len(pieces) {
+			break
+		}
+
+		next, shared := last+1, 0
+		for next-1 > first && shared+pieces[next-1].tokens <= overlap {
+			next--
+			shared += pieces[next].tokens
+		}
+		first = next
+	}
+
+	return chunks
+}
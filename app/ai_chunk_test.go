@@ -0,0 +1,41 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAiChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"empty", "", 4, 1, nil},
+		{"spaces", "  \n\t ", 4, 1, nil},
+		{"single chunk", "one two six ten", 8, 2, []string{"one two six ten"}},
+		{"overlap", "one two six ten", 2, 1, []string{"one two", "two six", "six ten"}},
+		{"no overlap", "one two six ten", 2, 0, []string{"one two", "six ten"}},
+		{"overlap as large as size", "one two six ten", 2, 2, []string{"one two", "two six", "six ten"}},
+		{"long word", "one extraordinarily two", 2, 1, []string{"one", "extraordinarily", "two"}},
+		{"whitespace kept inside", "one\ntwo  six", 3, 0, []string{"one\ntwo  six"}},
+		{"cjk", "日本語の文", 2, 0, []string{"日本", "語の", "文"}},
+		{"cjk and words", "go 言語", 2, 1, []string{"go 言", "言語"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, chunk := range aiChunks(nil, test.text, test.size, test.overlap) {
+				got = append(got, test.text[chunk[0]:chunk[1]])
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("aiChunks(%q, %d, %d) = %q, want %q", test.text, test.size, test.overlap, got, test.want)
+			}
+		})
+	}
+}
@@ -422,13 +422,17 @@ func (p *GGUFParser) GetTensorF32(name string) ([]float32, error) {
 }
 
 func (p *GGUFParser) GetTokenEmbedding(id int, hDim int) ([]float32, error) {
-	tInfo, ok := p.Tensors["token_embd.weight"]
+	return p.GetTensorRow("token_embd.weight", id, hDim)
+}
+
+func (p *GGUFParser) GetTensorRow(name string, id int, hDim int) ([]float32, error) {
+	tInfo, ok := p.Tensors[name]
 	if !ok {
-		return nil, fmt.Errorf("tensor token_embd.weight not found")
+		return nil, fmt.Errorf("tensor %s not found", name)
 	}
 
 	if len(tInfo.Dimensions) < 1 {
-		return nil, fmt.Errorf("token_embd.weight has no dimensions")
+		return nil, fmt.Errorf("%s has no dimensions", name)
 	}
 	dim0 := int64(tInfo.Dimensions[0])
 	var vocabSize int64
@@ -27,10 +27,7 @@ func addBias(x, bias []float32, rows, cols int) {
 	}
 }
 
-func gqa(q, k, v []float32, seqLen int) []float32 {
-	nH := cfgNumHeads
-	nKV := cfgNumKVHeads
-	hDim := cfgHeadDim
+func gqa(q, k, v []float32, seqLen, nH, nKV, hDim int) []float32 {
 	scale := float32(1.0 / math.Sqrt(float64(hDim)))
 	groupSize := nH / nKV
 	out := make([]float32, seqLen*nH*hDim)
@@ -196,47 +193,45 @@ func matMulQuant(a []float32, b Tensor, rows, in, out int) []float32 {
 	return res
 }
 
-func rmsNormRows(x, weight []float32, seqLen int) []float32 {
-	H := cfgHiddenSize
+func rmsNormRows(x, weight []float32, seqLen, H int, eps float32) []float32 {
 	out := make([]float32, seqLen*H)
 	for i := range seqLen {
-		rmsNormSlice(x[i*H:(i+1)*H], out[i*H:(i+1)*H], weight, H)
+		rmsNormSlice(x[i*H:(i+1)*H], out[i*H:(i+1)*H], weight, H, eps)
 	}
 	return out
 }
 
-func rmsNormVec(x, weight []float32) {
-	rmsNormSlice(x, x, weight, len(x))
+func rmsNormVec(x, weight []float32, eps float32) {
+	rmsNormSlice(x, x, weight, len(x), eps)
 }
 
-func rmsNormSlice(x, out, w []float32, n int) {
+func rmsNormSlice(x, out, w []float32, n int, eps float32) {
 	var ss float32
 	for _, v := range x[:n] {
 		ss += v * v
 	}
-	inv := float32(1.0 / math.Sqrt(float64(ss/float32(n))+float64(cfgRMSNormEps)))
+	inv := float32(1.0 / math.Sqrt(float64(ss/float32(n))+float64(eps)))
 	for i := range n {
 		out[i] = x[i] * inv * w[i]
 	}
 }
 
-func rmsNormHeads(x, weight []float32, seqLen, nHeads, headDim int) {
+func rmsNormHeads(x, weight []float32, seqLen, nHeads, headDim int, eps float32) {
 	for t := range seqLen {
 		for h := range nHeads {
 			base := t*nHeads*headDim + h*headDim
-			rmsNormSlice(x[base:base+headDim], x[base:base+headDim], weight, headDim)
+			rmsNormSlice(x[base:base+headDim], x[base:base+headDim], weight, headDim, eps)
 		}
 	}
 }
 
-func buildRoPECache(seqLen int) []float32 {
-	hDim := cfgHeadDim
+func buildRoPECache(seqLen, hDim int, theta float64) []float32 {
 	half := hDim / 2
 	cache := make([]float32, seqLen*hDim)
 	for pos := range seqLen {
 		row := cache[pos*hDim:]
 		for i := range half {
-			freq := 1.0 / math.Pow(cfgRopeTheta, float64(2*i)/float64(hDim))
+			freq := 1.0 / math.Pow(theta, float64(2*i)/float64(hDim))
 			angle := float64(pos) * freq
 			row[i] = float32(math.Cos(angle))
 			row[i+half] = float32(math.Sin(angle))
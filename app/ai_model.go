@@ -3,10 +3,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 )
 
-var (
+const (
 	cfgHiddenSize       = 1024
 	cfgNumLayers        = 28
 	cfgNumHeads         = 16
@@ -18,6 +19,7 @@ var (
 )
 
 type qwen3Model struct {
+	cfg         qwen3Config
 	embedTokens []float32
 	normWeight  []float32
 	layers      []qwen3Layer
@@ -43,23 +45,36 @@ type qwen3Layer struct {
 	downProj  Tensor
 }
 
-func loadModel(p *GGUFParser) (*qwen3Model, error) {
+type qwen3Config struct {
+	hiddenSize       int
+	numLayers        int
+	numHeads         int
+	numKVHeads       int
+	headDim          int
+	intermediateSize int
+	ropeTheta        float64
+	rmsNormEps       float32
+}
+
+func loadModelConfig(p *GGUFParser) (qwen3Config, error) {
+	var cfg qwen3Config
+
 	archRaw, ok := p.Metadata["general.architecture"]
 	if !ok {
-		return nil, fmt.Errorf("missing model architecture metadata")
+		return cfg, fmt.Errorf("missing model architecture metadata")
 	}
 	arch, ok := archRaw.(string)
 	if !ok {
-		return nil, fmt.Errorf("invalid architecture metadata type")
+		return cfg, fmt.Errorf("invalid architecture metadata type")
 	}
 
 	if arch != "qwen2" && arch != "qwen3" {
-		return nil, fmt.Errorf("local execution only supports Qwen3 models")
+		return cfg, fmt.Errorf("local execution only supports Qwen3 models")
 	}
 
 	tInfo, ok := p.Tensors["blk.0.attn_q.weight"]
 	if !ok || tInfo.Type != 8 {
-		return nil, fmt.Errorf("local execution only supports Q8.0 format")
+		return cfg, fmt.Errorf("local execution only supports Q8.0 format")
 	}
 
 	getUint32 := func(suffix string, fallback int) int {
@@ -102,25 +117,33 @@ func loadModel(p *GGUFParser) (*qwen3Model, error) {
 		return fallback
 	}
 
-	cfgNumLayers = getUint32("block_count", cfgNumLayers)
-	cfgHiddenSize = getUint32("embedding_length", cfgHiddenSize)
-	cfgNumHeads = getUint32("attention.head_count", cfgNumHeads)
-	cfgNumKVHeads = getUint32("attention.head_count_kv", cfgNumKVHeads)
-	cfgHeadDim = getUint32("attention.head_dim", cfgHeadDim)
-	if cfgHeadDim == 0 && cfgNumHeads > 0 {
-		cfgHeadDim = cfgHiddenSize / cfgNumHeads
+	cfg.numLayers = getUint32("block_count", cfgNumLayers)
+	cfg.hiddenSize = getUint32("embedding_length", cfgHiddenSize)
+	cfg.numHeads = getUint32("attention.head_count", cfgNumHeads)
+	cfg.numKVHeads = getUint32("attention.head_count_kv", cfgNumKVHeads)
+	cfg.headDim = getUint32("attention.head_dim", cfgHeadDim)
+	if cfg.headDim == 0 && cfg.numHeads > 0 {
+		cfg.headDim = cfg.hiddenSize / cfg.numHeads
+	}
+	cfg.intermediateSize = getUint32("feed_forward_length", cfgIntermediateSize)
+	cfg.ropeTheta = getFloat64("rope.freq_base", cfgRopeTheta)
+	cfg.rmsNormEps = getFloat32("attention.layer_norm_rms_epsilon", cfgRMSNormEps)
+
+	return cfg, nil
+}
+
+func loadModel(p *GGUFParser) (*qwen3Model, error) {
+	cfg, err := loadModelConfig(p)
+	if err != nil {
+		return nil, err
 	}
-	cfgIntermediateSize = getUint32("feed_forward_length", cfgIntermediateSize)
-	cfgRopeTheta = getFloat64("rope.freq_base", cfgRopeTheta)
-	cfgRMSNormEps = getFloat32("attention.layer_norm_rms_epsilon", cfgRMSNormEps)
 
 	m := &qwen3Model{
-		layers: make([]qwen3Layer, cfgNumLayers),
+		cfg:    cfg,
+		layers: make([]qwen3Layer, cfg.numLayers),
 		parser: p,
 	}
 
-	var err error
-
 	if options.aiCache {
 		if m.embedTokens, err = p.GetTensorF32("token_embd.weight"); err != nil {
 			return nil, err
@@ -192,9 +215,20 @@ func loadModel(p *GGUFParser) (*qwen3Model, error) {
 	return m, nil
 }
 
-func (m *qwen3Model) embed(tokenIDs []int) ([]float32, error) {
+func (m *qwen3Model) embed(ctx context.Context, tokenIDs []int) ([]float32, error) {
+	last, err := m.forward(ctx, tokenIDs)
+	if err != nil {
+		return nil, err
+	}
+	l2Norm(last)
+	return last, nil
+}
+
+// forward runs the transformer over tokenIDs and returns the normalized
+// hidden state of the last token.
+func (m *qwen3Model) forward(ctx context.Context, tokenIDs []int) ([]float32, error) {
 	seqLen := len(tokenIDs)
-	H := cfgHiddenSize
+	H := m.cfg.hiddenSize
 
 	hidden := make([]float32, seqLen*H)
 	if !options.aiCache {
@@ -211,18 +245,21 @@ func (m *qwen3Model) embed(tokenIDs []int) ([]float32, error) {
 		}
 	}
 
-	ropeCache := buildRoPECache(seqLen)
+	ropeCache := buildRoPECache(seqLen, m.cfg.headDim, m.cfg.ropeTheta)
 
 	for i := range m.layers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lw := &m.layers[i]
-		normed := rmsNormRows(hidden, lw.inputNorm, seqLen)
-		attn := selfAttention(normed, lw, ropeCache, seqLen)
+		normed := rmsNormRows(hidden, lw.inputNorm, seqLen, H, m.cfg.rmsNormEps)
+		attn := m.selfAttention(normed, lw, ropeCache, seqLen)
 		if attn == nil {
 			return nil, fmt.Errorf("selfAttention failed at layer %d", i)
 		}
 		vecAdd(hidden, attn)
-		normed2 := rmsNormRows(hidden, lw.postNorm, seqLen)
-		mlpOut := swigluMLP(normed2, lw, seqLen)
+		normed2 := rmsNormRows(hidden, lw.postNorm, seqLen, H, m.cfg.rmsNormEps)
+		mlpOut := m.swigluMLP(normed2, lw, seqLen)
 		if mlpOut == nil {
 			return nil, fmt.Errorf("swigluMLP failed at layer %d", i)
 		}
@@ -243,16 +280,15 @@ func (m *qwen3Model) embed(tokenIDs []int) ([]float32, error) {
 		normWeight = m.normWeight
 	}
 
-	rmsNormVec(last, normWeight)
-	l2Norm(last)
+	rmsNormVec(last, normWeight, m.cfg.rmsNormEps)
 	return last, nil
 }
 
-func selfAttention(x []float32, lw *qwen3Layer, ropeCache []float32, seqLen int) []float32 {
-	H := cfgHiddenSize
-	nH := cfgNumHeads
-	nKV := cfgNumKVHeads
-	hDim := cfgHeadDim
+func (m *qwen3Model) selfAttention(x []float32, lw *qwen3Layer, ropeCache []float32, seqLen int) []float32 {
+	H := m.cfg.hiddenSize
+	nH := m.cfg.numHeads
+	nKV := m.cfg.numKVHeads
+	hDim := m.cfg.headDim
 
 	var qProj, kProj, vProj, oProj Tensor
 	var err error
@@ -283,13 +319,13 @@ func selfAttention(x []float32, lw *qwen3Layer, ropeCache []float32, seqLen int)
 	v := matMulQuant(x, vProj, seqLen, H, nKV*hDim)
 	addBias(v, lw.vBias, seqLen, nKV*hDim)
 
-	rmsNormHeads(q, lw.qNorm, seqLen, nH, hDim)
-	rmsNormHeads(k, lw.kNorm, seqLen, nKV, hDim)
+	rmsNormHeads(q, lw.qNorm, seqLen, nH, hDim, m.cfg.rmsNormEps)
+	rmsNormHeads(k, lw.kNorm, seqLen, nKV, hDim, m.cfg.rmsNormEps)
 
 	applyRoPE(q, ropeCache, seqLen, nH, hDim)
 	applyRoPE(k, ropeCache, seqLen, nKV, hDim)
 
-	attnOut := gqa(q, k, v, seqLen)
+	attnOut := gqa(q, k, v, seqLen, nH, nKV, hDim)
 
 	if !options.aiCache {
 		oProj, err = lw.parser.GetTensor(fmt.Sprintf("blk.%d.attn_output.weight", lw.idx))
@@ -303,9 +339,9 @@ func selfAttention(x []float32, lw *qwen3Layer, ropeCache []float32, seqLen int)
 	return matMulQuant(attnOut, oProj, seqLen, nH*hDim, H)
 }
 
-func swigluMLP(x []float32, lw *qwen3Layer, seqLen int) []float32 {
-	H := cfgHiddenSize
-	I := cfgIntermediateSize
+func (m *qwen3Model) swigluMLP(x []float32, lw *qwen3Layer, seqLen int) []float32 {
+	H := m.cfg.hiddenSize
+	I := m.cfg.intermediateSize
 
 	var gateProj, upProj, downProj Tensor
 	var err error
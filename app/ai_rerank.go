@@ -0,0 +1,183 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AiRerankDocumentTokens = 512
+	aiRerankInstruct       = "Given a web search query, retrieve relevant passages that answer the query"
+	aiRerankPrefix         = "<|im_start|>system\nJudge whether the Document meets the requirements based on the Query and the Instruct provided. Note that the answer can only be \"yes\" or \"no\".<|im_end|>\n<|im_start|>user\n"
+)
+
+type aiReranker struct {
+	mu     sync.Mutex
+	tok    *bpeTokenizer
+	mdl    *qwen3Model
+	file   *os.File
+	suffix []int
+	yes    []float32
+	no     []float32
+}
+
+// The reranker has its own locks, so reranking does not hold up the query
+// embeddings: globalRerankMu guards loading and closing the model, mu of the
+// model serializes its forward passes, which share the tensor stream.
+var (
+	globalRerank   *aiReranker
+	globalRerankMu sync.RWMutex
+)
+
+// aiRerankInit loads a Qwen3 reranker GGUF, the file stays open to stream the
+// tensors unless -ai-cache keeps them in RAM.
+func aiRerankInit(modelPath string) error {
+	globalRerankMu.Lock()
+	defer globalRerankMu.Unlock()
+
+	file, err := os.Open(modelPath)
+	if err != nil {
+		return err
+	}
+
+	r, err := func() (*aiReranker, error) {
+		p, err := NewGGUFParser(NewBufferedReadSeeker(file, 256*1024))
+		if err != nil {
+			return nil, err
+		}
+		tok, err := loadTokenizer(p)
+		if err != nil {
+			return nil, err
+		}
+		mdl, err := loadModel(p)
+		if err != nil {
+			return nil, err
+		}
+
+		yesID, okYes := tok.vocab["yes"]
+		noID, okNo := tok.vocab["no"]
+		if !okYes || !okNo {
+			return nil, fmt.Errorf("reranker vocabulary without yes/no tokens")
+		}
+		output := "output.weight"
+		if _, ok := p.Tensors[output]; !ok {
+			output = "token_embd.weight"
+		}
+		yes, err := p.GetTensorRow(output, yesID, mdl.cfg.hiddenSize)
+		if err != nil {
+			return nil, err
+		}
+		no, err := p.GetTensorRow(output, noID, mdl.cfg.hiddenSize)
+		if err != nil {
+			return nil, err
+		}
+
+		suffix := tok.encodeRaw("<|im_end|>\n<|im_start|>assistant\n")
+		for _, part := range []string{"<think>", "\n\n", "</think>", "\n\n"} {
+			if id, ok := tok.vocab[part]; ok {
+				suffix = append(suffix, id)
+			} else {
+				suffix = append(suffix, tok.encodeRaw(part)...)
+			}
+		}
+
+		return &aiReranker{tok: tok, mdl: mdl, file: file, suffix: suffix, yes: yes, no: no}, nil
+	}()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	globalRerank = r
+	return nil
+}
+
+func aiRerankClose() {
+	globalRerankMu.Lock()
+	defer globalRerankMu.Unlock()
+
+	if globalRerank != nil {
+		globalRerank.file.Close()
+		globalRerank = nil
+	}
+}
+
+func aiRerankReady() bool {
+	globalRerankMu.RLock()
+	defer globalRerankMu.RUnlock()
+
+	return globalRerank != nil
+}
+
+// score returns the probability of the document being relevant to the query,
+// read from the "yes" and "no" logits of the next token.
+func (r *aiReranker) score(ctx context.Context, query string, document string) (float64, error) {
+	ids := r.tok.encodeRaw(aiRerankPrefix + "<Instruct>: " + aiRerankInstruct + "\n<Query>: " + query + "\n<Document>: ")
+	documentIDs := r.tok.encodeRaw(document)
+	if len(documentIDs) > AiRerankDocumentTokens {
+		documentIDs = documentIDs[:AiRerankDocumentTokens]
+	}
+	ids = append(ids, documentIDs...)
+	ids = append(ids, r.suffix...)
+
+	r.mu.Lock()
+	hidden, err := r.mdl.forward(ctx, ids)
+	r.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	logit := float64(dot(hidden, r.yes) - dot(hidden, r.no))
+	return 1 / (1 + math.Exp(-logit)), nil
+}
+
+// aiRerank scores the first top results against the query and sorts them by
+// relevance, the power becomes the relevance percentage while the other
+// results follow unchanged.
+func aiRerank(ctx context.Context, query string, results []SearchResult, top int) ([]SearchResult, error) {
+	globalRerankMu.RLock()
+	defer globalRerankMu.RUnlock()
+
+	if globalRerank == nil {
+		return nil, fmt.Errorf("reranker model not loaded")
+	}
+
+	start := time.Now()
+	top = min(top, len(results))
+	reranked := make([]SearchResult, top)
+	copy(reranked, results)
+	for i := range reranked {
+		text := reranked[i].Text
+		if text == "" {
+			text = reranked[i].Snippet
+		}
+		score, err := globalRerank.score(ctx, query, reranked[i].Title+"\n"+text)
+		if err != nil {
+			return nil, err
+		}
+		reranked[i].Power = score * 100
+		if reranked[i].Explain != nil {
+			explain := *reranked[i].Explain
+			explain.Rerank = &score
+			reranked[i].Explain = &explain
+		}
+	}
+
+	sort.SliceStable(reranked, func(i, j int) bool {
+		return reranked[i].Power > reranked[j].Power
+	})
+
+	if options.log {
+		log.Printf("Search rerank: %s, %d results (%v)", query, top, time.Since(start))
+	}
+	searchStage(ctx, "rerank", "", start, top)
+	return append(reranked, results[top:]...), nil
+}
@@ -64,6 +64,10 @@ func loadTokenizer(p *GGUFParser) (*bpeTokenizer, error) {
 }
 
 func (t *bpeTokenizer) encode(text string) []int {
+	return append(t.encodeRaw(text), t.eosID)
+}
+
+func (t *bpeTokenizer) encodeRaw(text string) []int {
 	segments := t.splitOnSpecials(text)
 	var ids []int
 	for _, seg := range segments {
@@ -75,7 +79,6 @@ func (t *bpeTokenizer) encode(text string) []int {
 			ids = append(ids, t.bpeSegment(seg)...)
 		}
 	}
-	ids = append(ids, t.eosID)
 	return ids
 }
 
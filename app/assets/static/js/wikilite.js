@@ -42,6 +42,11 @@ class SearchApp {
         this.ai = urlParams.get('ai') === 'true';
         
         this.configureAISearch();
+
+        const related = document.getElementById('related');
+        if (related) {
+            this.loadRelated(related.dataset.article, related, '', related.dataset.limit);
+        }
     }
 
     configureAISearch() {
@@ -167,6 +172,10 @@ class SearchApp {
         });
     }
 
+    articleRef(result) {
+      return result.source ? `${result.source}:${result.article_id}` : result.article_id
+    }
+
     checkTitleSnippet(title, snippet) {
       return title == snippet.replace("<mark>","").replace("</mark>","")
     }
@@ -181,7 +190,7 @@ class SearchApp {
         const titleLink = document.createElement('a');
         titleLink.href = '#';
         titleLink.className = 'text-decoration-none';
-        titleLink.addEventListener('click', () => this.showArticle(result.article_id));
+        titleLink.addEventListener('click', () => this.showArticle(this.articleRef(result)));
         if (type == "title" || this.checkTitleSnippet(result.title, result.snippet)) {
             titleLink.innerHTML = result.snippet;
         } else {
@@ -208,7 +217,7 @@ class SearchApp {
         if (totalResults === 0) {
             this.showNoResultsMessage(query);
         } else if (totalResults === 1) {
-            this.showArticle(allResults[0].article_id);
+            this.showArticle(this.articleRef(allResults[0]));
         }
     }
 
@@ -226,6 +235,7 @@ class SearchApp {
             
             await this.fetchArticle(articleId);
             this.displayArticle();
+            this.loadRelated(articleId, document.getElementById('articleRelated'), '../', 10);
         } catch (error) {
             console.error('Error showing article:', error);
         } finally {
@@ -234,7 +244,7 @@ class SearchApp {
     }
 
     async fetchArticle(articleId) {
-        const response = await fetch(`../api/article?id=${articleId}`);
+        const response = await fetch(`../api/article?id=${encodeURIComponent(articleId)}`);
         const data = await response.json();
         
         if (data.status === 'success') {
@@ -297,6 +307,52 @@ class SearchApp {
         return sectionDiv;
     }
 
+    async loadRelated(articleId, container, base, limit) {
+        if (!container) return;
+        container.replaceChildren();
+
+        try {
+            const response = await fetch(`${base}api/article/related?id=${encodeURIComponent(articleId)}&limit=${limit}`);
+            const data = await response.json();
+            if (data.status !== 'success' || !data.results || data.results.length === 0) return;
+
+            const title = document.createElement('h2');
+            title.className = 'mt-5 mb-3';
+            title.textContent = 'Related';
+
+            const list = document.createElement('ul');
+            list.className = 'list-group mb-4';
+            data.results.forEach(result => {
+                list.appendChild(this.createRelatedListItem(result, base));
+            });
+
+            container.replaceChildren(title, list);
+        } catch (error) {
+            console.error('Error loading related articles:', error);
+        }
+    }
+
+    createRelatedListItem(result, base) {
+        const li = document.createElement('li');
+        li.className = 'list-group-item';
+
+        const link = document.createElement('a');
+        link.href = `${base}article?id=${encodeURIComponent(this.articleRef(result))}#section-${result.section_id}`;
+        link.className = 'text-decoration-none';
+        link.textContent = result.title;
+        li.appendChild(link);
+
+        for (const text of [result.section_title ? `› ${result.section_title}` : '', result.source]) {
+            if (!text) continue;
+            const small = document.createElement('small');
+            small.className = 'text-muted';
+            small.textContent = text;
+            li.append(' ', small);
+        }
+
+        return li;
+    }
+
     showLoadingSpinner() {
         if (this.loadingSpinner) {
             this.loadingSpinner.classList.remove('d-none');
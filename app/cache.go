@@ -0,0 +1,366 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int   `json:"size"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+type resultCacheEntry struct {
+	key        string
+	results    []SearchResult
+	suggestion string
+	expires    time.Time
+}
+
+// resultCache keeps the latest search results in memory with LRU eviction.
+type resultCache struct {
+	mu     sync.Mutex
+	size   int
+	ttl    time.Duration
+	items  map[string]*list.Element
+	order  *list.List
+	hits   int64
+	misses int64
+}
+
+type embeddingCache struct {
+	pool   *sqlitex.Pool
+	model  string
+	size   int
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+var (
+	searchCache     *resultCache
+	queryEmbeddings *embeddingCache
+)
+
+// CacheInit creates the results cache and the persistent query embeddings cache.
+func CacheInit() error {
+	if options.cacheSize > 0 {
+		searchCache = &resultCache{
+			size:  options.cacheSize,
+			ttl:   time.Duration(options.cacheTtl) * time.Second,
+			items: make(map[string]*list.Element),
+			order: list.New(),
+		}
+	}
+
+	if !ai || options.cacheEmbeddings <= 0 || (!options.web && !options.cli) {
+		return nil
+	}
+	path := options.cachePath
+	if path == "" {
+		path = strings.TrimSuffix(options.dbPath, filepath.Ext(options.dbPath)) + ".cache.db"
+	}
+	pool, err := sqlitex.NewPool(path, sqlitex.PoolOptions{
+		PoolSize: 1,
+		Flags:    sqlite.OpenReadWrite | sqlite.OpenCreate | sqlite.OpenURI,
+		PrepareConn: func(conn *sqlite.Conn) error {
+			return sqlitex.ExecuteTransient(conn, "PRAGMA synchronous = OFF", nil)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error opening cache database: %v", err)
+	}
+
+	conn := pool.Get(context.Background())
+	if conn == nil {
+		pool.Close()
+		return fmt.Errorf("failed to get connection")
+	}
+	version := 0
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA user_version", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			version = stmt.ColumnInt(0)
+			return nil
+		},
+	}); err != nil {
+		pool.Put(conn)
+		pool.Close()
+		return fmt.Errorf("error reading cache version: %v", err)
+	}
+	var queries []string
+	if version < 1 {
+		queries = append(queries, `DROP TABLE IF EXISTS query_embeddings`, `PRAGMA user_version = 1`)
+	}
+	queries = append(queries,
+		`CREATE TABLE IF NOT EXISTS query_embeddings (
+			key TEXT PRIMARY KEY,
+			embedding BLOB,
+			used INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_query_embeddings_used ON query_embeddings (used)`,
+	)
+	for _, query := range queries {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			pool.Put(conn)
+			pool.Close()
+			return fmt.Errorf("error creating cache table: %v", err)
+		}
+	}
+	pool.Put(conn)
+
+	// A local model is identified by its GGUF checksum, not by its name.
+	model := options.aiModel
+	if !options.aiApi {
+		checksum, err := aiModelChecksum()
+		if err != nil {
+			pool.Close()
+			return fmt.Errorf("error reading model checksum: %v", err)
+		}
+		model = checksum
+	}
+
+	queryEmbeddings = &embeddingCache{pool: pool, model: model, size: options.cacheEmbeddings}
+	return nil
+}
+
+// CacheReset empties the search results cache.
+func CacheReset() {
+	if searchCache == nil {
+		return
+	}
+	searchCache.mu.Lock()
+	searchCache.items = make(map[string]*list.Element)
+	searchCache.order.Init()
+	searchCache.mu.Unlock()
+}
+
+func CacheClose() {
+	if queryEmbeddings != nil {
+		queryEmbeddings.pool.Close()
+		queryEmbeddings = nil
+	}
+}
+
+// CacheStatsGet returns the size, hits and misses of the enabled caches.
+func CacheStatsGet() map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+
+	if searchCache != nil {
+		searchCache.mu.Lock()
+		stats["results"] = CacheStats{
+			Entries: searchCache.order.Len(),
+			Size:    searchCache.size,
+			Hits:    searchCache.hits,
+			Misses:  searchCache.misses,
+		}
+		searchCache.mu.Unlock()
+	}
+
+	if queryEmbeddings != nil {
+		entries := 0
+		if conn := queryEmbeddings.pool.Get(context.Background()); conn != nil {
+			sqlitex.Execute(conn, "SELECT COUNT(*) FROM query_embeddings", &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					entries = int(stmt.ColumnInt64(0))
+					return nil
+				},
+			})
+			queryEmbeddings.pool.Put(conn)
+		}
+		stats["embeddings"] = CacheStats{
+			Entries: entries,
+			Size:    queryEmbeddings.size,
+			Hits:    queryEmbeddings.hits.Load(),
+			Misses:  queryEmbeddings.misses.Load(),
+		}
+	}
+
+	return stats
+}
+
+// SearchCached wraps searchFunc with the results cache, explained searches always run.
+func SearchCached(endpoint string, searchFunc SearchFunc) SearchFunc {
+	if searchCache == nil {
+		return searchFunc
+	}
+
+	return func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, string, error) {
+		if searchExplain(ctx) {
+			return searchFunc(ctx, query, settings, limit)
+		}
+		key := fmt.Sprintf("%s\x00%s\x00%d\x00%s|%g|%v|%t|%s", endpoint, query, limit, settings.Fusion, settings.RRFK, settings.Weights, settings.Rerank, settings.Group)
+		if results, suggestion, ok := searchCache.get(key); ok {
+			return results, suggestion, nil
+		}
+
+		results, suggestion, err := searchFunc(ctx, query, settings, limit)
+		if err == nil && ctx.Err() == nil {
+			searchCache.put(key, results, suggestion)
+		}
+		return results, suggestion, err
+	}
+}
+
+func (c *resultCache) get(key string) ([]SearchResult, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if ok {
+		entry := element.Value.(*resultCacheEntry)
+		if c.ttl == 0 || time.Now().Before(entry.expires) {
+			c.hits++
+			c.order.MoveToFront(element)
+			return append([]SearchResult{}, entry.results...), entry.suggestion, true
+		}
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+
+	c.misses++
+	return nil, "", false
+}
+
+func (c *resultCache) put(key string, results []SearchResult, suggestion string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &resultCacheEntry{
+		key:        key,
+		results:    append([]SearchResult{}, results...),
+		suggestion: suggestion,
+		expires:    time.Now().Add(c.ttl),
+	}
+	if element, ok := c.items[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// aiModelChecksum returns the sha256 of the local GGUF model.
+func aiModelChecksum() (string, error) {
+	if checksum, err := db.SetupGet("ggufChecksum"); err == nil && checksum != "" {
+		return checksum, nil
+	}
+
+	r, closeFn, err := openGGUFStream()
+	if err != nil {
+		return "", err
+	}
+	defer closeFn()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func embeddingCacheKey(model, prefix, text string) string {
+	hash := sha256.New()
+	for _, value := range []string{model, prefix, text} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// aiQueryEmbeddings returns the embedding of a search query, cached on disk.
+func aiQueryEmbeddings(ctx context.Context, query string) ([]float32, error) {
+	cache := queryEmbeddings
+	if cache == nil {
+		return aiEmbeddings(ctx, options.aiModelPrefixSearch+query)
+	}
+
+	key := embeddingCacheKey(cache.model, options.aiModelPrefixSearch, query)
+	embedding, err := cache.get(ctx, key)
+	if err != nil {
+		log.Printf("Query embeddings cache error: %v", err)
+	}
+	if embedding != nil {
+		cache.hits.Add(1)
+		return embedding, nil
+	}
+	cache.misses.Add(1)
+
+	embedding, err = aiEmbeddings(ctx, options.aiModelPrefixSearch+query)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.put(ctx, key, embedding); err != nil {
+		log.Printf("Query embeddings cache error: %v", err)
+	}
+	return embedding, nil
+}
+
+func (c *embeddingCache) get(ctx context.Context, key string) ([]float32, error) {
+	conn := c.pool.Get(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get connection")
+	}
+	defer c.pool.Put(conn)
+
+	var embedding []float32
+	err := sqlitex.Execute(conn, "SELECT embedding FROM query_embeddings WHERE key = ?", &sqlitex.ExecOptions{
+		Args: []any{key},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			blob := make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, blob)
+			if len(blob) > 0 && len(blob)%4 == 0 {
+				embedding = BytesToFloat32(blob)
+			}
+			return nil
+		},
+	})
+	if err != nil || embedding == nil {
+		return nil, err
+	}
+
+	err = sqlitex.Execute(conn, "UPDATE query_embeddings SET used = ? WHERE key = ?", &sqlitex.ExecOptions{
+		Args: []any{time.Now().UnixNano(), key},
+	})
+	return embedding, err
+}
+
+// put stores an embedding and drops the least recently used ones beyond the cache size.
+func (c *embeddingCache) put(ctx context.Context, key string, embedding []float32) error {
+	conn := c.pool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("failed to get connection")
+	}
+	defer c.pool.Put(conn)
+
+	err := sqlitex.Execute(conn, "INSERT OR REPLACE INTO query_embeddings (key, embedding, used) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+		Args: []any{key, Float32ToBytes(embedding), time.Now().UnixNano()},
+	})
+	if err != nil {
+		return err
+	}
+
+	return sqlitex.Execute(conn, "DELETE FROM query_embeddings WHERE used < (SELECT used FROM query_embeddings ORDER BY used DESC LIMIT 1 OFFSET ?)", &sqlitex.ExecOptions{
+		Args: []any{c.size - 1},
+	})
+}
@@ -4,26 +4,64 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
 
-const VectorsPerCentroid = 2500
+const (
+	VectorsPerCentroid  = 2500
+	VectorsAnnRescore   = 10
+	VectorsChunkRescore = 4
+)
+
+var ErrArticleNotFound = errors.New("article not found")
 
 type DBHandler struct {
-	pool *sqlitex.Pool
+	pool            *sqlitex.Pool
+	writer          *sqlitex.Pool
+	wal             bool
+	name            string
+	language        string
+	tokenizer       string
+	trigram         string
+	vocabularyIndex string
+	vocabularyTerms bool
+	titleIndex      string
+	model           string
+	annSize         int
+	chunkTokens     int
 }
 
 func NewDBHandler(dbPath string) (*DBHandler, error) {
-	isReadOnly := !options.aiSync && options.wikiImport == "" && options.aiModelImport == "" && !options.dbCompress
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+	isReadOnly := !options.aiSync && options.wikiImport == "" && options.aiModelImport == "" && !options.dbCompress && options.dbMerge == "" && options.dbTokenizer == "" && options.dbTrigram == "" && options.publish == ""
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) || options.dbWal {
 		isReadOnly = false
 	}
 
+	handler, err := openDBHandler(dbPath, isReadOnly, options.dbWal)
+	if err != nil {
+		return nil, err
+	}
+	handler.SetupLoad()
+
+	return handler, nil
+}
+
+func openDBHandler(dbPath string, isReadOnly bool, wal bool) (*DBHandler, error) {
+	journalMode := "OFF"
+	synchronous := "OFF"
+	if wal {
+		journalMode = "WAL"
+		synchronous = "NORMAL"
+	}
+
 	var conn *sqlite.Conn
 	var err error
 
@@ -41,8 +79,8 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 
 	if !isReadOnly {
 		pragmas := []string{
-			"PRAGMA synchronous = OFF",
-			"PRAGMA journal_mode = OFF",
+			"PRAGMA synchronous = " + synchronous,
+			"PRAGMA journal_mode = " + journalMode,
 			"PRAGMA foreign_keys = OFF",
 			"PRAGMA cache_size = -10000",
 			"PRAGMA mmap_size = 268435456",
@@ -63,7 +101,8 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 			`CREATE TABLE IF NOT EXISTS articles (
 				id INTEGER PRIMARY KEY,
 				title TEXT NOT NULL,
-				entity TEXT NOT NULL
+				entity TEXT NOT NULL,
+				title_norm TEXT
 			)`,
 			`CREATE VIRTUAL TABLE IF NOT EXISTS article_search USING fts5(
 				title,
@@ -86,11 +125,19 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 				content_rowid='id'
 			)`,
 			`CREATE VIRTUAL TABLE IF NOT EXISTS section_search_vocabulary USING fts5vocab(section_search, row)`,
-			`CREATE TABLE IF NOT EXISTS vocabulary (term TEXT)`,
+			`CREATE TABLE IF NOT EXISTS vocabulary (term TEXT, frequency INTEGER DEFAULT 0)`,
+			`CREATE TABLE IF NOT EXISTS vocabulary_deletes (key INTEGER, length INTEGER, term_id INTEGER, PRIMARY KEY (key, length, term_id)) WITHOUT ROWID`,
 			`CREATE TABLE IF NOT EXISTS vectors (
 				id INTEGER PRIMARY KEY,
 				embedding BLOB
 			)`,
+			`CREATE TABLE IF NOT EXISTS passages (
+				id INTEGER PRIMARY KEY,
+				section_id INTEGER NOT NULL,
+				text_start INTEGER NOT NULL,
+				text_end INTEGER NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_passages_section_id ON passages (section_id)`,
 			`CREATE TABLE IF NOT EXISTS vectors_ann_chunks (
 				id INTEGER PRIMARY KEY,
 				chunk BLOB
@@ -112,6 +159,8 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 			`CREATE INDEX IF NOT EXISTS idx_vectors_ann_centroid_chunks ON vectors_ann_centroid_chunks (centroid_id)`,
 			`CREATE INDEX IF NOT EXISTS idx_vectors_ann_index_chunk_id_position ON vectors_ann_index (chunk_id, chunk_position)`,
 			`CREATE INDEX IF NOT EXISTS idx_sections_article_id ON sections(article_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_articles_title ON articles(title)`,
+			`CREATE INDEX IF NOT EXISTS idx_articles_entity ON articles(entity)`,
 		}
 		for _, query := range queries {
 			if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
@@ -172,7 +221,7 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 					cacheVal = "-1000"
 				}
 				pragmas = []string{
-					"PRAGMA synchronous = OFF",
+					"PRAGMA synchronous = " + synchronous,
 					"PRAGMA foreign_keys = OFF",
 					"PRAGMA cache_size = " + cacheVal,
 					"PRAGMA mmap_size = " + mmapVal,
@@ -194,12 +243,41 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 		opts.PoolSize = 1
 	}
 
+	if wal {
+		writerOpts := opts
+		writer, err := sqlitex.NewPool(dbPath, writerOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error opening database writer pool: %v", err)
+		}
+
+		opts.PoolSize = poolSize
+		opts.Flags = sqlite.OpenReadWrite | sqlite.OpenURI
+		prepareWriter := opts.PrepareConn
+		opts.PrepareConn = func(conn *sqlite.Conn) error {
+			if err := prepareWriter(conn); err != nil {
+				return err
+			}
+			return sqlitex.ExecuteTransient(conn, "PRAGMA query_only = ON", nil)
+		}
+
+		pool, err := sqlitex.NewPool(dbPath, opts)
+		if err != nil {
+			writer.Close()
+			return nil, fmt.Errorf("error opening database pool: %v", err)
+		}
+
+		handler := &DBHandler{pool: pool, writer: writer, wal: true}
+		handler.setupInfo()
+
+		return handler, nil
+	}
+
 	pool, err := sqlitex.NewPool(dbPath, opts)
 	if err != nil {
 		return nil, fmt.Errorf("error opening database pool: %v", err)
 	}
 
-	handler := &DBHandler{pool: pool}
+	handler := &DBHandler{pool: pool, writer: pool}
 
 	if !isReadOnly {
 		if err := handler.PragmaInitMode(); err != nil {
@@ -213,30 +291,21 @@ func NewDBHandler(dbPath string) (*DBHandler, error) {
 		}
 	}
 
-	if language, err := handler.SetupGet("language"); err == nil && language != "" {
-		options.language = language
-	}
-
-	if model, err := handler.SetupGet("model"); err == nil && model != "" {
-		options.aiModel = model
-	}
-
-	if annSize, err := handler.SetupGet("annSize"); err == nil && annSize != "" {
-		options.aiAnnSize = extractNumberFromString(annSize)
-	}
-
-	if modelPrefixSearch, err := handler.SetupGet("modelPrefixSearch"); err == nil && modelPrefixSearch != "" {
-		options.aiModelPrefixSearch = modelPrefixSearch
-	}
-
-	if modelPrefixSave, err := handler.SetupGet("modelPrefixSave"); err == nil && modelPrefixSave != "" {
-		options.aiModelPrefixSave = modelPrefixSave
-	}
+	handler.setupInfo()
 
 	return handler, nil
 }
 
 func (h *DBHandler) Close() error {
+	if h.wal {
+		if conn := h.writer.Get(context.Background()); conn != nil {
+			if err := sqlitex.ExecuteTransient(conn, "PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+				log.Printf("Error checkpointing WAL: %v", err)
+			}
+			h.writer.Put(conn)
+		}
+		h.writer.Close()
+	}
 	return h.pool.Close()
 }
 
@@ -267,6 +336,9 @@ func (h *DBHandler) PragmaInitMode() error {
 }
 
 func (h *DBHandler) PragmaReadMode() error {
+	if h.wal {
+		return nil
+	}
 	pragmas := []string{
 		"PRAGMA locking_mode = NORMAL",
 		"PRAGMA query_only = ON",
@@ -275,6 +347,9 @@ func (h *DBHandler) PragmaReadMode() error {
 }
 
 func (h *DBHandler) PragmaImportMode() error {
+	if h.wal {
+		return nil
+	}
 	pragmas := []string{
 		"PRAGMA locking_mode = EXCLUSIVE",
 		"PRAGMA query_only = OFF",
@@ -283,11 +358,11 @@ func (h *DBHandler) PragmaImportMode() error {
 }
 
 func (h *DBHandler) Optimize() error {
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
 	log.Println("Deleting duplicate sections")
 	err := func() error {
@@ -318,17 +393,57 @@ func (h *DBHandler) Optimize() error {
 }
 
 func (h *DBHandler) SetupPut(key, value string) error {
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
 	return sqlitex.Execute(conn, "INSERT OR REPLACE INTO setup (key, value) VALUES (?, ?)", &sqlitex.ExecOptions{
 		Args: []any{key, value},
 	})
 }
 
+func (h *DBHandler) setupInfo() {
+	h.language, _ = h.SetupGet("language")
+	h.tokenizer, _ = h.SetupGet("tokenizer")
+	h.trigram, _ = h.SetupGet("trigram")
+	h.vocabularyIndex, _ = h.SetupGet("vocabularyIndex")
+	h.vocabularyTerms = h.vocabularyTermsIndexed()
+	h.titleIndex, _ = h.SetupGet("titleIndex")
+	h.model, _ = h.SetupGet("model")
+	if annSize, err := h.SetupGet("annSize"); err == nil && annSize != "" {
+		h.annSize = extractNumberFromString(annSize)
+	}
+	if chunkTokens, err := h.SetupGet("chunkTokens"); err == nil && chunkTokens != "" {
+		h.chunkTokens = extractNumberFromString(chunkTokens)
+	}
+}
+
+func (h *DBHandler) SetupLoad() {
+	h.setupInfo()
+
+	if language, err := h.SetupGet("language"); err == nil && language != "" {
+		options.language = language
+	}
+
+	if model, err := h.SetupGet("model"); err == nil && model != "" {
+		options.aiModel = model
+	}
+
+	if annSize, err := h.SetupGet("annSize"); err == nil && annSize != "" {
+		options.aiAnnSize = extractNumberFromString(annSize)
+	}
+
+	if modelPrefixSearch, err := h.SetupGet("modelPrefixSearch"); err == nil && modelPrefixSearch != "" {
+		options.aiModelPrefixSearch = modelPrefixSearch
+	}
+
+	if modelPrefixSave, err := h.SetupGet("modelPrefixSave"); err == nil && modelPrefixSave != "" {
+		options.aiModelPrefixSave = modelPrefixSave
+	}
+}
+
 func (h *DBHandler) SetupGet(key string) (string, error) {
 	conn := h.pool.Get(context.Background())
 	if conn == nil {
@@ -356,11 +471,11 @@ func (h *DBHandler) SetupGet(key string) (string, error) {
 }
 
 func (h *DBHandler) ArticlePut(article OutputArticle) error {
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
 	var err error
 	deferFn := sqlitex.Transaction(conn)
@@ -389,8 +504,8 @@ func (h *DBHandler) ArticlePut(article OutputArticle) error {
 	return nil
 }
 
-func (h *DBHandler) ArticleGet(articleID int) (ArticleResult, error) {
-	conn := h.pool.Get(context.Background())
+func (h *DBHandler) ArticleGet(ctx context.Context, articleID int) (ArticleResult, error) {
+	conn := h.pool.Get(ctx)
 	if conn == nil {
 		return ArticleResult{}, fmt.Errorf("failed to get connection")
 	}
@@ -409,7 +524,8 @@ func (h *DBHandler) ArticleGet(articleID int) (ArticleResult, error) {
 			a.entity,
 			s.id,
 			s.title,
-			s.content
+			s.content,
+			s.content_flate
 		FROM
 			articles a
 		JOIN
@@ -425,11 +541,10 @@ func (h *DBHandler) ArticleGet(articleID int) (ArticleResult, error) {
 		Args: []any{articleID},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			var (
-				artID          int
-				artTitle       string
-				artEntity      string
-				section        ArticleResultSection
-				sectionContent string
+				artID     int
+				artTitle  string
+				artEntity string
+				section   ArticleResultSection
 			)
 
 			artID = int(stmt.ColumnInt64(0))
@@ -437,26 +552,7 @@ func (h *DBHandler) ArticleGet(articleID int) (ArticleResult, error) {
 			artEntity = stmt.ColumnText(2)
 			section.ID = int(stmt.ColumnInt64(3))
 			section.Title = stmt.ColumnText(4)
-			sectionContent = stmt.ColumnText(5)
-
-			if sectionContent != "" {
-				section.Content = sectionContent
-			} else {
-				var contentFlate []byte
-				err := sqlitex.Execute(conn, "SELECT content_flate FROM sections WHERE id = ?", &sqlitex.ExecOptions{
-					Args: []any{section.ID},
-					ResultFunc: func(subStmt *sqlite.Stmt) error {
-						contentFlate = make([]byte, subStmt.ColumnLen(0))
-						subStmt.ColumnBytes(0, contentFlate)
-						return nil
-					},
-				})
-				if err == nil && len(contentFlate) > 0 {
-					if content, err := TextInflate(contentFlate); err == nil {
-						section.Content = content
-					}
-				}
-			}
+			section.Content = sectionContent(stmt, 5)
 
 			if isFirstRow {
 				article.ID = artID
@@ -475,7 +571,7 @@ func (h *DBHandler) ArticleGet(articleID int) (ArticleResult, error) {
 	}
 
 	if article.ID == 0 {
-		return article, fmt.Errorf("article not found")
+		return article, ErrArticleNotFound
 	}
 
 	log.Printf("Article retrieve: %d (%v)", articleID, time.Since(start))
@@ -483,12 +579,104 @@ func (h *DBHandler) ArticleGet(articleID int) (ArticleResult, error) {
 	return article, nil
 }
 
+func (h *DBHandler) ArticleIDByTitle(ctx context.Context, title string) (int, error) {
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	var id int
+	err := sqlitex.Execute(conn, "SELECT id FROM articles WHERE title = ? LIMIT 1", &sqlitex.ExecOptions{
+		Args: []any{title},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = int(stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("article query error: %v", err)
+	}
+	if id > 0 {
+		return id, nil
+	}
+
+	normalized := TextNormalize(title)
+	if normalized == "" {
+		return 0, ErrArticleNotFound
+	}
+
+	if h.titleIndex == titleIndexVersion {
+		err = sqlitex.Execute(conn, "SELECT id FROM articles WHERE title_norm = ? LIMIT 1", &sqlitex.ExecOptions{
+			Args: []any{normalized},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				id = int(stmt.ColumnInt64(0))
+				return nil
+			},
+		})
+	} else {
+		err = sqlitex.Execute(conn, `
+			SELECT a.id, a.title
+			FROM article_search
+			JOIN articles a ON a.id = article_search.rowid
+			WHERE article_search MATCH ?
+			ORDER BY bm25(article_search)
+			LIMIT 100`, &sqlitex.ExecOptions{
+			Args: []any{sanitizeFTSQuery(normalized, h.tokenizer)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if id == 0 && TextNormalize(stmt.ColumnText(1)) == normalized {
+					id = int(stmt.ColumnInt64(0))
+				}
+				return nil
+			},
+		})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("article query error: %v", err)
+	}
+	if id == 0 {
+		return 0, ErrArticleNotFound
+	}
+
+	return id, nil
+}
+
+func (h *DBHandler) ArticleIDByEntity(ctx context.Context, entity string) (int, error) {
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	entity = strings.ToUpper(strings.TrimSpace(entity))
+	if _, err := strconv.Atoi(entity); err == nil {
+		entity = "Q" + entity
+	}
+
+	var id int
+	err := sqlitex.Execute(conn, "SELECT id FROM articles WHERE entity = ? LIMIT 1", &sqlitex.ExecOptions{
+		Args: []any{entity},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = int(stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("article query error: %v", err)
+	}
+	if id == 0 {
+		return 0, ErrArticleNotFound
+	}
+
+	return id, nil
+}
+
 func (h *DBHandler) Compress() error {
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
 	var totalSections int
 	err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM sections WHERE content IS NOT NULL AND content != ''", &sqlitex.ExecOptions{
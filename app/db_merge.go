@@ -0,0 +1,338 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func (h *DBHandler) Merge(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("merge database not found: %s", path)
+	}
+
+	start := time.Now()
+	rebuildAnn := false
+
+	err := func() error {
+		conn := h.writer.Get(context.Background())
+		if conn == nil {
+			return fmt.Errorf("failed to get connection")
+		}
+		defer h.writer.Put(conn)
+
+		err := sqlitex.ExecuteTransient(conn, "ATTACH DATABASE ? AS merge", &sqlitex.ExecOptions{
+			Args: []any{path},
+		})
+		if err != nil {
+			return fmt.Errorf("error attaching merge database: %v", err)
+		}
+		defer sqlitex.ExecuteTransient(conn, "DETACH DATABASE merge", nil)
+
+		mergeHasVectors := mergeHasRows(conn, "merge.vectors")
+		mergeHasPassages := mergeHasRows(conn, "merge.passages")
+		mergeHasAnn := mergeHasRows(conn, "merge.vectors_ann_index")
+		mainHasVectors := mergeHasRows(conn, "main.vectors")
+		mainHasAnn := mergeHasRows(conn, "main.vectors_ann_index")
+		if mergeHasAnn && !mergeHasVectors {
+			return fmt.Errorf("cannot merge an ANN index without its vectors")
+		}
+		if mainHasAnn && !mainHasVectors && mergeHasVectors {
+			return fmt.Errorf("cannot add vectors to an ANN index without its vectors")
+		}
+		rebuildAnn = mergeHasVectors && (mainHasAnn || mergeHasAnn)
+		if mergeHasVectors && mainHasVectors && mergeHasPassages != mergeHasRows(conn, "main.passages") {
+			return fmt.Errorf("cannot merge vectors of sections with vectors of passages")
+		}
+		if mergeHasVectors && (mainHasVectors || mainHasAnn) {
+			for _, key := range []string{"model", "annSize", "chunkTokens", "chunkOverlap"} {
+				mainValue := mergeSetupValue(conn, "main", key)
+				mergeValue := mergeSetupValue(conn, "merge", key)
+				if key == "annSize" && (mainValue == "" || mergeValue == "") {
+					continue
+				}
+				if mainValue != mergeValue {
+					return fmt.Errorf("cannot merge vectors with different %s: %q != %q", key, mainValue, mergeValue)
+				}
+			}
+		}
+
+		var conflicts, duplicates int
+		err = sqlitex.ExecuteTransient(conn, `
+			SELECT
+				COALESCE(SUM(a.title != m.title), 0),
+				COALESCE(SUM(a.title = m.title), 0)
+			FROM merge.articles m
+			JOIN main.articles a ON a.id = m.id`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				conflicts = int(stmt.ColumnInt64(0))
+				duplicates = int(stmt.ColumnInt64(1))
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error checking article collisions: %v", err)
+		}
+		if duplicates > 0 {
+			log.Printf("Merge: %d articles already present, keeping the existing ones", duplicates)
+		}
+		if conflicts > 0 {
+			log.Printf("Merge: %d articles share an ID with a different title, assigning them new IDs", conflicts)
+		}
+
+		var articleOffset int64
+		err = sqlitex.ExecuteTransient(conn, "SELECT MAX((SELECT COALESCE(MAX(id), 0) FROM main.articles), (SELECT COALESCE(MAX(id), 0) FROM merge.articles))", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				articleOffset = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error reading article offset: %v", err)
+		}
+
+		var sectionOffset int64
+		err = sqlitex.ExecuteTransient(conn, "SELECT COALESCE(MAX(id), 0) FROM main.sections", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				sectionOffset = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error reading section offset: %v", err)
+		}
+
+		var passageOffset int64
+		err = sqlitex.ExecuteTransient(conn, "SELECT COALESCE(MAX(id), 0) FROM main.passages", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				passageOffset = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error reading passage offset: %v", err)
+		}
+
+		deferFn := sqlitex.Transaction(conn)
+		defer deferFn(&err)
+
+		// merge_articles maps the ID of every article to merge to its ID in
+		// main: the same one, or a new one above both databases when it is
+		// already taken by a different article.
+		queries := []string{
+			`DROP TABLE IF EXISTS temp.merge_articles`,
+			`CREATE TEMP TABLE merge_articles (id INTEGER PRIMARY KEY, new_id INTEGER)`,
+			`INSERT INTO temp.merge_articles (id, new_id)
+				SELECT id, id FROM merge.articles
+				WHERE id NOT IN (SELECT id FROM main.articles)`,
+		}
+		for _, query := range queries {
+			if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+				return fmt.Errorf("error merging articles: %v", err)
+			}
+		}
+
+		err = sqlitex.ExecuteTransient(conn, `
+			INSERT INTO temp.merge_articles (id, new_id)
+			SELECT m.id, ? + ROW_NUMBER() OVER (ORDER BY m.id) FROM merge.articles m
+			JOIN main.articles a ON a.id = m.id
+			WHERE a.title != m.title`, &sqlitex.ExecOptions{
+			Args: []any{articleOffset},
+		})
+		if err != nil {
+			return fmt.Errorf("error remapping article IDs: %v", err)
+		}
+
+		queries = []string{
+			`INSERT INTO main.articles (id, title, entity)
+				SELECT t.new_id, m.title, m.entity FROM merge.articles m
+				JOIN temp.merge_articles t ON t.id = m.id`,
+			`INSERT INTO main.article_search (rowid, title)
+				SELECT id, title FROM main.articles
+				WHERE id IN (SELECT new_id FROM temp.merge_articles)`,
+		}
+		for _, query := range queries {
+			if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+				return fmt.Errorf("error merging articles: %v", err)
+			}
+		}
+
+		err = sqlitex.ExecuteTransient(conn, `
+			INSERT INTO main.sections (id, article_id, title, content, content_flate, pow)
+			SELECT s.id + ?, t.new_id, s.title, s.content, s.content_flate, s.pow FROM merge.sections s
+			JOIN temp.merge_articles t ON t.id = s.article_id
+			ORDER BY s.id`, &sqlitex.ExecOptions{
+			Args: []any{sectionOffset},
+		})
+		if err != nil {
+			return fmt.Errorf("error merging sections: %v", err)
+		}
+
+		if mergeHasVectors && mergeHasPassages {
+			err = sqlitex.ExecuteTransient(conn, `
+				INSERT INTO main.passages (id, section_id, text_start, text_end)
+				SELECT p.id + ?, p.section_id + ?, p.text_start, p.text_end FROM merge.passages p
+				JOIN merge.sections s ON s.id = p.section_id
+				WHERE s.article_id IN (SELECT id FROM temp.merge_articles)`, &sqlitex.ExecOptions{
+				Args: []any{passageOffset, sectionOffset},
+			})
+			if err != nil {
+				return fmt.Errorf("error merging passages: %v", err)
+			}
+
+			err = sqlitex.ExecuteTransient(conn, `
+				INSERT OR REPLACE INTO main.vectors (id, embedding)
+				SELECT v.id + ?, v.embedding FROM merge.vectors v
+				JOIN merge.passages p ON p.id = v.id
+				JOIN merge.sections s ON s.id = p.section_id
+				WHERE s.article_id IN (SELECT id FROM temp.merge_articles)`, &sqlitex.ExecOptions{
+				Args: []any{passageOffset},
+			})
+			if err != nil {
+				return fmt.Errorf("error merging vectors: %v", err)
+			}
+		} else if mergeHasVectors {
+			err = sqlitex.ExecuteTransient(conn, `
+				INSERT OR REPLACE INTO main.vectors (id, embedding)
+				SELECT v.id + ?, v.embedding FROM merge.vectors v
+				JOIN merge.sections s ON s.id = v.id
+				WHERE s.article_id IN (SELECT id FROM temp.merge_articles)`, &sqlitex.ExecOptions{
+				Args: []any{sectionOffset},
+			})
+			if err != nil {
+				return fmt.Errorf("error merging vectors: %v", err)
+			}
+		}
+
+		if mergeHasVectors && !mainHasVectors {
+			err = sqlitex.ExecuteTransient(conn, `
+				INSERT OR REPLACE INTO main.setup (key, value)
+				SELECT key, value FROM merge.setup
+				WHERE key IN ('model', 'modelPrefixSave', 'modelPrefixSearch', 'annSize', 'chunkTokens', 'chunkOverlap')`, nil)
+			if err != nil {
+				return fmt.Errorf("error merging embeddings setup: %v", err)
+			}
+		}
+
+		err = sqlitex.ExecuteTransient(conn, `
+			SELECT m.key FROM merge.setup m
+			JOIN main.setup s ON s.key = m.key
+			WHERE s.value IS NOT m.value
+			ORDER BY m.key`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				log.Printf("Merge: keeping the %s setup of the main database", stmt.ColumnText(0))
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error comparing setup: %v", err)
+		}
+
+		err = sqlitex.ExecuteTransient(conn, "INSERT OR IGNORE INTO main.setup (key, value) SELECT key, value FROM merge.setup", nil)
+		if err != nil {
+			return fmt.Errorf("error merging setup: %v", err)
+		}
+
+		type section struct {
+			id      int64
+			title   string
+			content string
+		}
+		var sections []section
+		err = sqlitex.ExecuteTransient(conn, "SELECT id, title, content, content_flate FROM main.sections WHERE id > ?", &sqlitex.ExecOptions{
+			Args: []any{sectionOffset},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				s := section{
+					id:      stmt.ColumnInt64(0),
+					title:   stmt.ColumnText(1),
+					content: stmt.ColumnText(2),
+				}
+				if s.content == "" && stmt.ColumnLen(3) > 0 {
+					contentFlate := make([]byte, stmt.ColumnLen(3))
+					stmt.ColumnBytes(3, contentFlate)
+					if content, err := TextInflate(contentFlate); err == nil {
+						s.content = content
+					}
+				}
+				sections = append(sections, s)
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error loading merged sections: %v", err)
+		}
+
+		for _, s := range sections {
+			err = sqlitex.Execute(conn, "INSERT INTO main.section_search (rowid, title, content) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+				Args: []any{s.id, s.title, s.content},
+			})
+			if err != nil {
+				return fmt.Errorf("error indexing merged section: %v", err)
+			}
+		}
+
+		log.Printf("Merge: %d sections added", len(sections))
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	h.SetupLoad()
+
+	log.Println("Merge: indexing titles")
+	if err := h.ProcessTitleIndex(); err != nil {
+		return err
+	}
+
+	log.Println("Merge: rebuilding vocabulary")
+	if err := h.ProcessVocabulary(); err != nil {
+		return err
+	}
+
+	if h.trigram != "" {
+		log.Println("Merge: rebuilding trigram index")
+		if err := h.ProcessTrigram(h.trigram); err != nil {
+			return err
+		}
+	}
+
+	if rebuildAnn {
+		log.Println("Merge: rebuilding ANN tables")
+		if err := h.ProcessANN(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Merge completed in %v", time.Since(start))
+	return nil
+}
+
+func mergeHasRows(conn *sqlite.Conn, table string) bool {
+	var found bool
+	sqlitex.ExecuteTransient(conn, "SELECT 1 FROM "+table+" LIMIT 1", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	return found
+}
+
+func mergeSetupValue(conn *sqlite.Conn, schema string, key string) string {
+	var value string
+	sqlitex.ExecuteTransient(conn, "SELECT value FROM "+schema+".setup WHERE key = ? LIMIT 1", &sqlitex.ExecOptions{
+		Args: []any{key},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			value = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	return value
+}
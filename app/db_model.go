@@ -4,6 +4,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -21,14 +23,15 @@ func (h *DBHandler) AiModelImport(path string) error {
 		return fmt.Errorf("failed to read file: %v", err)
 	}
 
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
-	err = sqlitex.ExecuteTransient(conn, `INSERT OR REPLACE INTO setup (key, value) VALUES ('gguf', ?)`, &sqlitex.ExecOptions{
-		Args: []any{data},
+	checksum := sha256.Sum256(data)
+	err = sqlitex.ExecuteTransient(conn, `INSERT OR REPLACE INTO setup (key, value) VALUES ('gguf', ?), ('ggufChecksum', ?)`, &sqlitex.ExecOptions{
+		Args: []any{data, hex.EncodeToString(checksum[:])},
 	})
 	if err != nil {
 		return fmt.Errorf("failed to import model into database: %v", err)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,26 +16,140 @@ import (
 )
 
 func (h *DBHandler) ProcessTitles() error {
-	conn := h.pool.Get(context.Background())
+	err := func() error {
+		conn := h.writer.Get(context.Background())
+		if conn == nil {
+			return fmt.Errorf("failed to get connection")
+		}
+		defer h.writer.Put(conn)
+
+		err := sqlitex.Execute(conn, "INSERT INTO article_search(rowid, title) SELECT id, title FROM articles", nil)
+		if err != nil {
+			return fmt.Errorf("error populating article_search table: %v", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := h.ProcessTitleIndex(); err != nil {
+		return err
+	}
+
+	if options.dbTrigram != "" {
+		return h.ProcessTrigram(options.dbTrigram)
+	}
+
+	return nil
+}
+
+const (
+	titleIndexVersion = "title_norm:2"
+	titleIndexBatch   = 10000
+)
+
+// ProcessTitleIndex stores the normalized title of the articles still
+// missing it and indexes titles, normalized titles and entities, so the
+// lookups by title and entity of read-only databases use indexes too.
+func (h *DBHandler) ProcessTitleIndex() error {
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
-	err := sqlitex.Execute(conn, "INSERT INTO article_search(rowid, title) SELECT id, title FROM articles", nil)
+	start := time.Now()
+	hasColumn := false
+	err := sqlitex.Execute(conn, "SELECT 1 FROM pragma_table_info('articles') WHERE name = 'title_norm'", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			hasColumn = true
+			return nil
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("error populating article_search table: %v", err)
+		return fmt.Errorf("error reading articles schema: %v", err)
+	}
+	if !hasColumn {
+		if err := sqlitex.ExecuteTransient(conn, "ALTER TABLE articles ADD COLUMN title_norm TEXT", nil); err != nil {
+			return fmt.Errorf("error adding normalized titles: %v", err)
+		}
+	} else if h.titleIndex != titleIndexVersion {
+		if err := sqlitex.ExecuteTransient(conn, "UPDATE articles SET title_norm = NULL", nil); err != nil {
+			return fmt.Errorf("error clearing normalized titles: %v", err)
+		}
 	}
 
+	type title struct {
+		id    int64
+		title string
+	}
+	var last int64
+	var total int
+	for {
+		var titles []title
+		err := sqlitex.Execute(conn, "SELECT id, title FROM articles WHERE id > ? AND title_norm IS NULL ORDER BY id LIMIT ?", &sqlitex.ExecOptions{
+			Args: []any{last, titleIndexBatch},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				titles = append(titles, title{id: stmt.ColumnInt64(0), title: stmt.ColumnText(1)})
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error loading titles: %v", err)
+		}
+		if len(titles) == 0 {
+			break
+		}
+
+		err = func() (err error) {
+			defer sqlitex.Save(conn)(&err)
+			for _, t := range titles {
+				err = sqlitex.Execute(conn, "UPDATE articles SET title_norm = ? WHERE id = ?", &sqlitex.ExecOptions{
+					Args: []any{TextNormalize(t.title), t.id},
+				})
+				if err != nil {
+					return fmt.Errorf("error storing normalized title: %v", err)
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+		last = titles[len(titles)-1].id
+		total += len(titles)
+	}
+
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_articles_title ON articles(title)`,
+		`CREATE INDEX IF NOT EXISTS idx_articles_entity ON articles(entity)`,
+		`CREATE INDEX IF NOT EXISTS idx_articles_title_norm ON articles(title_norm)`,
+	}
+	for _, query := range queries {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return fmt.Errorf("error creating title index: %v", err)
+		}
+	}
+
+	err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO setup (key, value) VALUES ('titleIndex', ?)", &sqlitex.ExecOptions{
+		Args: []any{titleIndexVersion},
+	})
+	if err != nil {
+		return fmt.Errorf("error storing title index version: %v", err)
+	}
+	h.titleIndex = titleIndexVersion
+
+	log.Printf("Title index: %d titles normalized (%v)", total, time.Since(start))
 	return nil
 }
 
 func (h *DBHandler) ProcessContents() error {
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
 	err := sqlitex.Execute(conn, "INSERT INTO section_search(rowid, title, content) SELECT id, title, content FROM sections", nil)
 	if err != nil {
@@ -45,22 +160,82 @@ func (h *DBHandler) ProcessContents() error {
 }
 
 func (h *DBHandler) ProcessVocabulary() error {
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
+	defer h.writer.Put(conn)
 
-	err := sqlitex.Execute(conn, "INSERT OR IGNORE INTO vocabulary SELECT term FROM article_search_vocabulary", nil)
-	if err != nil {
-		return fmt.Errorf("error populating vocabulary table: %v", err)
+	var err error
+	deferFn := sqlitex.Transaction(conn)
+	defer deferFn(&err)
+
+	queries := []string{
+		`DROP TABLE IF EXISTS vocabulary`,
+		`CREATE TABLE vocabulary (term TEXT, frequency INTEGER DEFAULT 0)`,
+	}
+	for _, query := range queries {
+		if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return fmt.Errorf("error clearing vocabulary table: %v", err)
+		}
 	}
 
-	err = sqlitex.Execute(conn, "INSERT OR IGNORE INTO vocabulary SELECT term FROM section_search_vocabulary", nil)
+	sources := []string{"article_search_vocabulary", "section_search_vocabulary"}
+	if h.tokenizer != "" && h.tokenizer != "unicode61" {
+		sources = []string{"vocabulary_search_vocabulary"}
+		queries := []string{
+			`CREATE VIRTUAL TABLE vocabulary_search USING fts5(title, content, content='sections', content_rowid='id', detail='none')`,
+			`INSERT INTO vocabulary_search(vocabulary_search) VALUES('rebuild')`,
+			`INSERT INTO vocabulary_search(rowid, title) SELECT -id, title FROM articles`,
+			`CREATE VIRTUAL TABLE vocabulary_search_vocabulary USING fts5vocab(vocabulary_search, row)`,
+		}
+		for _, query := range queries {
+			if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+				return fmt.Errorf("error building vocabulary index: %v", err)
+			}
+		}
+		defer func() {
+			sqlitex.ExecuteTransient(conn, "DROP TABLE IF EXISTS vocabulary_search_vocabulary", nil)
+			sqlitex.ExecuteTransient(conn, "DROP TABLE IF EXISTS vocabulary_search", nil)
+		}()
+	}
+
+	var terms []string
+	for _, source := range sources {
+		terms = append(terms, "SELECT term, COALESCE(cnt, doc) AS cnt FROM "+source)
+	}
+	err = sqlitex.ExecuteTransient(conn, "INSERT INTO vocabulary (term, frequency) SELECT term, SUM(cnt) FROM ("+strings.Join(terms, " UNION ALL ")+") GROUP BY term ORDER BY term", nil)
 	if err != nil {
 		return fmt.Errorf("error populating vocabulary table: %v", err)
 	}
+	if err = sqlitex.ExecuteTransient(conn, "CREATE INDEX idx_vocabulary_term ON vocabulary (term, frequency)", nil); err != nil {
+		return fmt.Errorf("error creating vocabulary term index: %v", err)
+	}
+	h.vocabularyTerms = true
+
+	err = h.processVocabularyIndex(conn)
+	return err
+}
 
+// ProcessChunking stores the passage size of -ai-chunk-tokens in a database
+// without embeddings, the ones already embedded keep their passages. It runs
+// before serving, so the searches never see the size change.
+func (h *DBHandler) ProcessChunking() error {
+	if options.aiChunkTokens == 0 || h.chunkTokens > 0 {
+		return nil
+	}
+	if h.AiHasVectors() || h.AiHasANN() {
+		log.Printf("Embeddings already stored by section, keeping one vector per section")
+		return nil
+	}
+
+	if err := h.SetupPut("chunkTokens", strconv.Itoa(options.aiChunkTokens)); err != nil {
+		return err
+	}
+	if err := h.SetupPut("chunkOverlap", strconv.Itoa(options.aiChunkOverlap)); err != nil {
+		return err
+	}
+	h.chunkTokens = options.aiChunkTokens
 	return nil
 }
 
@@ -81,22 +256,41 @@ func (h *DBHandler) ProcessEmbeddings() (err error) {
 		return
 	}
 
+	chunkTokens, chunkOverlap := h.chunkTokens, options.aiChunkOverlap
+	if chunkTokens > 0 {
+		if overlap, err := h.SetupGet("chunkOverlap"); err == nil && overlap != "" {
+			chunkOverlap = extractNumberFromString(overlap)
+		}
+	}
+
+	var tok *bpeTokenizer
+	if chunkTokens > 0 {
+		log.Printf("Embedding passages of %d tokens with %d tokens of overlap", chunkTokens, chunkOverlap)
+		if tok = aiTokenizer(); tok == nil {
+			log.Printf("Embedding model tokenizer not available, estimating the passage tokens from their length")
+		}
+	}
+
 	log.Printf("Loading pending vector IDs for Embeddings processing...")
 
 	var pendingSectionIDs []int
 	var problematicIDs []int
 
 	err = func() error {
-		conn := h.pool.Get(context.Background())
+		conn := h.writer.Get(context.Background())
 		if conn == nil {
 			return fmt.Errorf("failed to get connection")
 		}
-		defer h.pool.Put(conn)
+		defer h.writer.Put(conn)
 
+		embedded := "SELECT id FROM vectors"
+		if chunkTokens > 0 {
+			embedded = "SELECT section_id FROM passages"
+		}
 		err = sqlitex.Execute(conn, `
 			SELECT s.id 
 			FROM sections s 
-			WHERE s.id NOT IN (SELECT id FROM vectors)
+			WHERE s.id NOT IN (`+embedded+`)
 			ORDER BY s.id`, &sqlitex.ExecOptions{
 			ResultFunc: func(stmt *sqlite.Stmt) error {
 				pendingSectionIDs = append(pendingSectionIDs, int(stmt.ColumnInt64(0)))
@@ -166,26 +360,51 @@ func (h *DBHandler) ProcessEmbeddings() (err error) {
 					return err
 				}
 
+				type passageData struct {
+					section   int
+					start     int
+					end       int
+					text      string
+					embedding []float32
+				}
+				var passages []passageData
+				for _, s := range sections {
+					ranges := [][2]int{{0, len(s.content)}}
+					if chunkTokens > 0 {
+						if chunks := aiChunks(tok, s.content, chunkTokens, chunkOverlap); len(chunks) > 0 {
+							ranges = chunks
+						}
+					}
+					for _, r := range ranges {
+						passages = append(passages, passageData{
+							section: s.id,
+							start:   r[0],
+							end:     r[1],
+							text:    options.aiModelPrefixSave + s.aTitle + " - " + s.sTitle + "\n\n" + s.content[r[0]:r[1]],
+						})
+					}
+				}
+
+				failed := make(map[int]bool)
 				subBatchSize := 64
-				for i := 0; i < len(sections); i += subBatchSize {
-					endIdx := min(i+subBatchSize, len(sections))
-					chunk := sections[i:endIdx]
+				for i := 0; i < len(passages); i += subBatchSize {
+					endIdx := min(i+subBatchSize, len(passages))
+					chunk := passages[i:endIdx]
 
 					var texts []string
-					for _, s := range chunk {
-						fullSectionText := s.aTitle + " - " + s.sTitle + "\n\n" + s.content
-						texts = append(texts, options.aiModelPrefixSave+fullSectionText)
+					for _, p := range chunk {
+						texts = append(texts, p.text)
 					}
 
 					var embeddings [][]float32
 					var err error
 
 					if options.aiApi {
-						embeddings, err = aiApiEmbeddingsBatch(texts)
+						embeddings, err = aiApiEmbeddingsBatch(context.Background(), texts)
 					} else {
 						embeddings = make([][]float32, len(chunk))
 						for idx, text := range texts {
-							embeddings[idx], err = localAiEmbeddings(text)
+							embeddings[idx], err = localAiEmbeddings(context.Background(), text)
 							if err != nil {
 								break
 							}
@@ -194,21 +413,58 @@ func (h *DBHandler) ProcessEmbeddings() (err error) {
 
 					if err != nil {
 						log.Printf("Embedding generation error for batch starting at index %d: %v", i, err)
-						for _, s := range chunk {
-							problematicIDs = append(problematicIDs, s.id)
+						for _, p := range chunk {
+							failed[p.section] = true
 						}
 						continue
 					}
 
-					for idx, s := range chunk {
-						err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO vectors (id, embedding) VALUES (?, ?)", &sqlitex.ExecOptions{
-							Args: []any{s.id, Float32ToBytes(embeddings[idx])},
-						})
+					for idx := range chunk {
+						chunk[idx].embedding = embeddings[idx]
+					}
+				}
+
+				for i := 0; i < len(passages); {
+					section := passages[i].section
+					end := i
+					for end < len(passages) && passages[end].section == section {
+						end++
+					}
+					if !failed[section] {
+						err := func() (err error) {
+							release := sqlitex.Save(conn)
+							defer release(&err)
+
+							for _, p := range passages[i:end] {
+								id := int64(p.section)
+								if chunkTokens > 0 {
+									err = sqlitex.Execute(conn, "INSERT INTO passages (section_id, text_start, text_end) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+										Args: []any{p.section, p.start, p.end},
+									})
+									if err != nil {
+										return err
+									}
+									id = conn.LastInsertRowID()
+								}
+								err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO vectors (id, embedding) VALUES (?, ?)", &sqlitex.ExecOptions{
+									Args: []any{id, Float32ToBytes(p.embedding)},
+								})
+								if err != nil {
+									return err
+								}
+							}
+							return nil
+						}()
 						if err != nil {
-							log.Printf("Error inserting vector for section %d: %v", s.id, err)
-							problematicIDs = append(problematicIDs, s.id)
+							log.Printf("Error inserting vector for section %d: %v", section, err)
+							failed[section] = true
 						}
 					}
+					i = end
+				}
+
+				for section := range failed {
+					problematicIDs = append(problematicIDs, section)
 				}
 
 				return nil
@@ -216,6 +472,7 @@ func (h *DBHandler) ProcessEmbeddings() (err error) {
 			if err != nil {
 				return err
 			}
+			CacheReset()
 
 			processed += len(batchIDs)
 			progress := float64(processed) / float64(totalCount) * 100
@@ -260,28 +517,11 @@ func (h *DBHandler) ProcessANN() error {
 
 	log.Printf("Loading pending vector IDs for ANN processing using MRL and size %d...", size)
 
-	conn := h.pool.Get(context.Background())
+	conn := h.writer.Get(context.Background())
 	if conn == nil {
 		return fmt.Errorf("failed to get connection")
 	}
-	defer h.pool.Put(conn)
-
-	err := sqlitex.Execute(conn, "DELETE FROM vectors_ann_index", nil)
-	if err != nil {
-		return err
-	}
-	err = sqlitex.Execute(conn, "DELETE FROM vectors_ann_chunks", nil)
-	if err != nil {
-		return err
-	}
-	err = sqlitex.Execute(conn, "DELETE FROM vectors_ann_centroids", nil)
-	if err != nil {
-		return err
-	}
-	err = sqlitex.Execute(conn, "DELETE FROM vectors_ann_centroid_chunks", nil)
-	if err != nil {
-		return err
-	}
+	defer h.writer.Put(conn)
 
 	type clusterItem struct {
 		id  int
@@ -289,7 +529,7 @@ func (h *DBHandler) ProcessANN() error {
 	}
 	var mrlItems []clusterItem
 
-	err = sqlitex.Execute(conn, "SELECT id, embedding FROM vectors ORDER BY id", &sqlitex.ExecOptions{
+	err := sqlitex.Execute(conn, "SELECT id, embedding FROM vectors ORDER BY id", &sqlitex.ExecOptions{
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			embBytes := make([]byte, stmt.ColumnLen(1))
 			stmt.ColumnBytes(1, embBytes)
@@ -416,6 +656,19 @@ func (h *DBHandler) ProcessANN() error {
 		deferFn := sqlitex.Transaction(conn)
 		defer deferFn(&err)
 
+		for _, table := range []string{"vectors_ann_index", "vectors_ann_chunks", "vectors_ann_centroids", "vectors_ann_centroid_chunks"} {
+			if err = sqlitex.Execute(conn, "DELETE FROM "+table, nil); err != nil {
+				return err
+			}
+		}
+
+		err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO setup (key, value) VALUES ('annVectorsMax', ?)", &sqlitex.ExecOptions{
+			Args: []any{fmt.Sprintf("%d", mrlItems[totalCount-1].id)},
+		})
+		if err != nil {
+			return err
+		}
+
 		for cIdx, group := range groups {
 			centroidBytes := Float32ToBytes(centroids[cIdx])
 			err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO vectors_ann_centroids (id, centroid) VALUES (?, ?)", &sqlitex.ExecOptions{
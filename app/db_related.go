@@ -0,0 +1,64 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ArticleEmbeddings returns the embeddings of the sections, or passages, of
+// an article, read from vectors or, when only the ANN index is kept, the MRL
+// prefixes stored in its chunks.
+func (h *DBHandler) ArticleEmbeddings(ctx context.Context, id int) ([][]float32, error) {
+	hasVectors := h.AiHasVectors()
+	if !hasVectors && !h.AiHasANN() {
+		return nil, nil
+	}
+
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	annSize := h.annSize
+	if annSize == 0 {
+		annSize = options.aiAnnSize
+	}
+
+	vectorsIDs := "SELECT id FROM sections WHERE article_id = ?"
+	if h.chunkTokens > 0 {
+		vectorsIDs = "SELECT p.id FROM sections s JOIN passages p ON p.section_id = s.id WHERE s.article_id = ?"
+	}
+	sqlQuery := "SELECT embedding FROM vectors WHERE id IN (" + vectorsIDs + ")"
+	args := []any{id}
+	if !hasVectors {
+		sqlQuery = `
+			SELECT substr(c.chunk, i.chunk_position * ? + 1, ?)
+			FROM vectors_ann_index i
+			JOIN vectors_ann_chunks c ON c.id = i.chunk_id
+			WHERE i.vectors_id IN (` + vectorsIDs + `)`
+		args = []any{annSize * 4, annSize * 4, id}
+	}
+
+	var embeddings [][]float32
+	err := sqlitex.Execute(conn, sqlQuery, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			blob := make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, blob)
+			if len(blob) > 0 && len(blob)%4 == 0 {
+				embeddings = append(embeddings, BytesToFloat32(blob))
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return embeddings, nil
+}
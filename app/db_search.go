@@ -5,6 +5,7 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -34,8 +35,8 @@ func normalizeBM25(score float64) float64 {
 	return (1.0 - math.Exp(-c*rawScore)) * 100.0
 }
 
-func sanitizeFTSQuery(query string) string {
-	words := strings.Fields(query)
+func sanitizeFTSQuery(query string, tokenizer string) string {
+	words := ftsQueryWords(query, tokenizer)
 	if len(words) == 0 {
 		return ""
 	}
@@ -47,8 +48,38 @@ func sanitizeFTSQuery(query string) string {
 	return strings.Join(sanitized, " ")
 }
 
-func (h *DBHandler) SearchTitle(searchQuery string, limit int) ([]SearchResult, error) {
-	conn := h.pool.Get(context.Background())
+// sqlLimit returns a LIMIT clause with the value written in the query. A
+// bound LIMIT on a full-text table makes SQLite prepare the cached statement
+// again at every execution, which costs as much as the search itself.
+func sqlLimit(limit int) string {
+	return " LIMIT " + strconv.Itoa(limit)
+}
+
+func sectionContent(stmt *sqlite.Stmt, col int) string {
+	if content := stmt.ColumnText(col); content != "" {
+		return content
+	}
+	if size := stmt.ColumnLen(col + 1); size > 0 {
+		contentFlate := make([]byte, size)
+		stmt.ColumnBytes(col+1, contentFlate)
+		if content, err := TextInflate(contentFlate); err == nil {
+			return content
+		}
+	}
+	return ""
+}
+
+func (h *DBHandler) SearchTitle(ctx context.Context, searchQuery string, limit int) ([]SearchResult, error) {
+	node, err := QueryParse(searchQuery)
+	if err != nil {
+		return nil, err
+	}
+	match := ftsMatch(node, ftsArticleColumns, h.tokenizer)
+	if match == "" {
+		return nil, nil
+	}
+
+	conn := h.pool.Get(ctx)
 	if conn == nil {
 		return nil, fmt.Errorf("failed to get connection")
 	}
@@ -56,40 +87,48 @@ func (h *DBHandler) SearchTitle(searchQuery string, limit int) ([]SearchResult,
 
 	start := time.Now()
 	sqlQuery := `
-		SELECT 
-			rowid, 
-			title, 
-			snippet(article_search, 0, '<mark>', '</mark>', '...', 16) as snippet,
-			bm25(article_search) AS power
-		FROM article_search
-		WHERE article_search MATCH ?
-		ORDER BY power ASC
-		LIMIT ?
+		SELECT
+			t.rowid,
+			t.title,
+			t.snippet,
+			t.power,
+			s.content,
+			s.content_flate,
+			s.id,
+			s.title
+		FROM (
+			SELECT
+				rowid,
+				title,
+				snippet(article_search, 0, '<mark>', '</mark>', '...', 16) AS snippet,
+				bm25(article_search) AS power
+			FROM article_search
+			WHERE article_search MATCH ?
+			ORDER BY power ASC` + sqlLimit(limit) + `
+		) t
+		LEFT JOIN sections s ON s.id = (SELECT MIN(id) FROM sections WHERE article_id = t.rowid)
+		ORDER BY t.power ASC
 	`
 
-	sanitized := sanitizeFTSQuery(searchQuery)
+	explain := searchExplain(ctx)
 	var results []SearchResult
-	err := sqlitex.ExecuteTransient(conn, sqlQuery, &sqlitex.ExecOptions{
-		Args: []any{sanitized, limit},
+	err = sqlitex.Execute(conn, sqlQuery, &sqlitex.ExecOptions{
+		Args: []any{match},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			var result SearchResult
 			result.ArticleID = int(stmt.ColumnInt64(0))
 			result.Title = stmt.ColumnText(1)
 			result.Snippet = stmt.ColumnText(2)
 			result.Power = normalizeBM25(stmt.ColumnFloat(3))
+			if explain {
+				result.Explain = explainBM25("article_search", stmt.ColumnFloat(3))
+			}
 
-			var textContent string
-			contentQuery := `SELECT content FROM sections WHERE article_id = ? ORDER BY id LIMIT 1`
-			sqlitex.ExecuteTransient(conn, contentQuery, &sqlitex.ExecOptions{
-				Args: []any{result.ArticleID},
-				ResultFunc: func(subStmt *sqlite.Stmt) error {
-					textContent = subStmt.ColumnText(0)
-					return nil
-				},
-			})
-			if textContent != "" {
+			if textContent := sectionContent(stmt, 4); textContent != "" {
 				result.Text = Snippet(textContent)
 			}
+			result.SectionID = int(stmt.ColumnInt64(6))
+			result.SectionTitle = stmt.ColumnText(7)
 			if result.Snippet == "" {
 				result.Snippet = Snippet(result.Text)
 			}
@@ -103,11 +142,33 @@ func (h *DBHandler) SearchTitle(searchQuery string, limit int) ([]SearchResult,
 	}
 
 	log.Printf("Search title: %s (%v)", searchQuery, time.Since(start))
+	searchStage(ctx, "title", h.name, start, len(results))
 	return results, nil
 }
 
-func (h *DBHandler) SearchContent(searchQuery string, limit int) ([]SearchResult, error) {
-	conn := h.pool.Get(context.Background())
+func (h *DBHandler) SearchContent(ctx context.Context, searchQuery string, limit int) ([]SearchResult, error) {
+	node, err := QueryParse(searchQuery)
+	if err != nil {
+		return nil, err
+	}
+	rest, include, exclude := ftsTitleFilter(node)
+	match := ftsMatch(rest, ftsSectionColumns, h.tokenizer)
+	if match == "" {
+		return nil, nil
+	}
+
+	args := []any{match}
+	var filter string
+	if titles := ftsMatch(include, ftsArticleColumns, h.tokenizer); titles != "" {
+		filter += " AND s.article_id IN (SELECT rowid FROM article_search WHERE article_search MATCH ?)"
+		args = append(args, titles)
+	}
+	if titles := ftsMatch(exclude, ftsArticleColumns, h.tokenizer); titles != "" {
+		filter += " AND s.article_id NOT IN (SELECT rowid FROM article_search WHERE article_search MATCH ?)"
+		args = append(args, titles)
+	}
+
+	conn := h.pool.Get(ctx)
 	if conn == nil {
 		return nil, fmt.Errorf("failed to get connection")
 	}
@@ -118,47 +179,35 @@ func (h *DBHandler) SearchContent(searchQuery string, limit int) ([]SearchResult
 		SELECT
 			s.article_id,
 			a.title,
-			s.id,
-			s.content,
 			snippet(section_search, 1, '<mark>', '</mark>', '...', 64) as snippet,
-			bm25(section_search) as power
+			bm25(section_search) as power,
+			s.content,
+			s.content_flate,
+			s.id,
+			s.title
 		FROM section_search
 		JOIN sections s ON section_search.rowid = s.id
 		JOIN articles a ON s.article_id = a.id
-		WHERE section_search MATCH ?
-		ORDER BY power
-		LIMIT ?
+		WHERE section_search MATCH ?` + filter + `
+		ORDER BY power` + sqlLimit(limit) + `
 	`
 
-	sanitized := sanitizeFTSQuery(searchQuery)
+	explain := searchExplain(ctx)
 	var results []SearchResult
-	err := sqlitex.ExecuteTransient(conn, sqlQuery, &sqlitex.ExecOptions{
-		Args: []any{sanitized, limit},
+	err = sqlitex.Execute(conn, sqlQuery, &sqlitex.ExecOptions{
+		Args: args,
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			var result SearchResult
 			result.ArticleID = int(stmt.ColumnInt64(0))
 			result.Title = stmt.ColumnText(1)
-			sectionID := int(stmt.ColumnInt64(2))
-			result.Text = stmt.ColumnText(3)
-			result.Snippet = stmt.ColumnText(4)
-			result.Power = normalizeBM25(stmt.ColumnFloat(5))
-
-			if result.Text == "" {
-				var contentFlate []byte
-				sqlitex.ExecuteTransient(conn, "SELECT content_flate FROM sections WHERE id = ?", &sqlitex.ExecOptions{
-					Args: []any{sectionID},
-					ResultFunc: func(subStmt *sqlite.Stmt) error {
-						contentFlate = make([]byte, subStmt.ColumnLen(0))
-						subStmt.ColumnBytes(0, contentFlate)
-						return nil
-					},
-				})
-				if len(contentFlate) > 0 {
-					if content, err := TextInflate(contentFlate); err == nil {
-						result.Text = content
-					}
-				}
+			result.Snippet = stmt.ColumnText(2)
+			result.Power = normalizeBM25(stmt.ColumnFloat(3))
+			if explain {
+				result.Explain = explainBM25("section_search", stmt.ColumnFloat(3))
 			}
+			result.Text = sectionContent(stmt, 4)
+			result.SectionID = int(stmt.ColumnInt64(6))
+			result.SectionTitle = stmt.ColumnText(7)
 
 			if result.Snippet == "" {
 				result.Snippet = Snippet(result.Text)
@@ -173,11 +222,16 @@ func (h *DBHandler) SearchContent(searchQuery string, limit int) ([]SearchResult
 	}
 
 	log.Printf("Search content: %s (%v)", searchQuery, time.Since(start))
+	searchStage(ctx, "content", h.name, start, len(results))
 	return results, nil
 }
 
-func (h *DBHandler) SearchWordDistance(inputWord string, limit int) ([]SearchResult, error) {
-	conn := h.pool.Get(context.Background())
+func (h *DBHandler) SearchWordDistance(ctx context.Context, inputWord string, limit int) ([]SearchResult, error) {
+	if h.vocabularyIndex == vocabularyIndexVersion {
+		return h.searchVocabularyIndex(ctx, inputWord, limit)
+	}
+
+	conn := h.pool.Get(ctx)
 	if conn == nil {
 		return nil, fmt.Errorf("failed to get connection")
 	}
@@ -186,32 +240,45 @@ func (h *DBHandler) SearchWordDistance(inputWord string, limit int) ([]SearchRes
 	start := time.Now()
 	var allMatches []SearchResult
 	seen := make(map[string]bool)
+	threshold := math.MaxFloat64
+
+	sortMatches := func() {
+		sort.SliceStable(allMatches, func(i, j int) bool {
+			return allMatches[i].Power < allMatches[j].Power
+		})
+		if len(allMatches) >= limit {
+			allMatches = allMatches[:limit]
+			if limit > 0 {
+				threshold = allMatches[limit-1].Power
+			}
+		}
+	}
 
 	batchSize := 100000
-	offset := 0
+	var lastID int64
 
 	for {
 		processed := 0
-		err := sqlitex.ExecuteTransient(conn, "SELECT term FROM vocabulary LIMIT ? OFFSET ?", &sqlitex.ExecOptions{
-			Args: []any{batchSize, offset},
+		err := sqlitex.Execute(conn, "SELECT rowid, term FROM vocabulary WHERE rowid > ? ORDER BY rowid LIMIT ?", &sqlitex.ExecOptions{
+			Args: []any{lastID, batchSize},
 			ResultFunc: func(stmt *sqlite.Stmt) error {
-				word := stmt.ColumnText(0)
+				lastID = stmt.ColumnInt64(0)
+				processed++
+
+				word := stmt.ColumnText(1)
 				if seen[word] {
 					return nil
 				}
 				seen[word] = true
 
 				distance := LevenshteinDistance(inputWord, word)
+				if float64(distance) >= threshold {
+					return nil
+				}
 				allMatches = append(allMatches, SearchResult{Text: word, Power: float64(distance)})
-
-				if len(allMatches) > limit {
-					sort.Slice(allMatches, func(i, j int) bool {
-						return allMatches[i].Power < allMatches[j].Power
-					})
-					allMatches = allMatches[:limit]
+				if len(allMatches) >= limit*2 {
+					sortMatches()
 				}
-
-				processed++
 				return nil
 			},
 		})
@@ -222,77 +289,123 @@ func (h *DBHandler) SearchWordDistance(inputWord string, limit int) ([]SearchRes
 		if processed < batchSize {
 			break
 		}
-		offset += batchSize
 	}
 
-	sort.Slice(allMatches, func(i, j int) bool {
-		return allMatches[i].Power < allMatches[j].Power
-	})
+	sortMatches()
 
 	log.Printf("Search word distance: %s (%v)", inputWord, time.Since(start))
 	return allMatches, nil
 }
 
-func (h *DBHandler) SearchVectors(query string, limit int) ([]SearchResult, error) {
-	hasAnn := db.AiHasANN()
-	hasVectors := db.AiHasVectors()
+func (h *DBHandler) SearchVectors(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	queryEmbedding, err := aiQueryEmbeddings(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.SearchEmbedding(ctx, queryEmbedding, limit)
+}
+
+func (h *DBHandler) SearchEmbedding(ctx context.Context, queryEmbedding []float32, limit int) ([]SearchResult, error) {
+	hasVectors := h.AiHasVectors()
+	hasAnn := h.AiHasANN() && !(hasVectors && ctx.Value(searchExactKey{}) != nil)
 
 	if !hasAnn && !hasVectors {
 		log.Println("Warning, embeddings search requested but not available")
 		return nil, nil
 	}
 
-	queryEmbedding, err := aiEmbeddings(options.aiModelPrefixSearch + query)
-	if err != nil {
-		return nil, err
+	annSize := h.annSize
+	if annSize == 0 {
+		annSize = options.aiAnnSize
+	}
+
+	vectorsLimit := limit
+	if h.chunkTokens > 0 {
+		vectorsLimit = limit * VectorsChunkRescore
 	}
 
+	explain := searchExplain(ctx)
+	annExplain := make(map[int64]*SearchExplainAnn)
 	var topAnnResults []VectorDistance
 	if hasAnn {
-		annLimit := limit
+		annLimit := vectorsLimit
 		if hasVectors {
-			annLimit = limit * limit
+			annLimit = vectorsLimit * VectorsAnnRescore
 		}
 		var err error
-		topAnnResults, err = h.SearchAnn(queryEmbedding, options.aiAnnSize, annLimit)
+		topAnnResults, err = h.SearchAnn(ctx, queryEmbedding, annSize, annLimit)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	conn := h.pool.Get(context.Background())
+	conn := h.pool.Get(ctx)
 	if conn == nil {
 		return nil, fmt.Errorf("failed to get connection")
 	}
 	defer h.pool.Put(conn)
 
 	start := time.Now()
-	topResults := make([]VectorDistance, 0, limit)
+	topResults := make([]VectorDistance, 0, vectorsLimit)
 	sqlQuery := "SELECT id, embedding FROM vectors"
+	var sqlArgs []any
 
 	if hasAnn {
-		var vectorsIDsString []string
-		for _, v := range topAnnResults {
-			var vectorsID int64
-			err := sqlitex.ExecuteTransient(conn, "SELECT vectors_id FROM vectors_ann_index WHERE chunk_id = ? AND chunk_position = ? LIMIT 1", &sqlitex.ExecOptions{
-				Args: []any{v.ChunkRowID, v.ChunkPosition},
-				ResultFunc: func(stmt *sqlite.Stmt) error {
-					vectorsID = stmt.ColumnInt64(0)
-					return nil
-				},
-			})
-			if err != nil {
-				return nil, err
-			}
+		positions := make([][2]int64, len(topAnnResults))
+		for i, v := range topAnnResults {
+			positions[i] = [2]int64{v.ChunkRowID, int64(v.ChunkPosition)}
+		}
+		positionsJSON, _ := json.Marshal(positions)
+
+		vectorsIDs := make(map[[2]int64]int64, len(positions))
+		err := sqlitex.Execute(conn, `
+			SELECT i.chunk_id, i.chunk_position, i.vectors_id
+			FROM json_each(?) j
+			JOIN vectors_ann_index i ON i.chunk_id = j.value ->> 0 AND i.chunk_position = j.value ->> 1`, &sqlitex.ExecOptions{
+			Args: []any{string(positionsJSON)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				vectorsIDs[[2]int64{stmt.ColumnInt64(0), stmt.ColumnInt64(1)}] = stmt.ColumnInt64(2)
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
 
+		var candidates []int64
+		for i, v := range topAnnResults {
+			vectorsID, ok := vectorsIDs[positions[i]]
+			if !ok {
+				continue
+			}
+			if explain {
+				annExplain[vectorsID] = &SearchExplainAnn{
+					Centroid:   v.Centroid,
+					Rank:       i + 1,
+					Similarity: float64(v.Distance),
+					Candidates: len(topAnnResults),
+				}
+			}
 			if !hasVectors {
 				topResults = append(topResults, VectorDistance{ID: vectorsID, Distance: v.Distance})
 			} else {
-				vectorsIDsString = append(vectorsIDsString, strconv.FormatInt(vectorsID, 10))
+				candidates = append(candidates, vectorsID)
 			}
 		}
 		if hasVectors {
-			sqlQuery += " WHERE id IN (" + strings.Join(vectorsIDsString, ",") + ")"
+			annVectorsMax := int64(math.MaxInt64)
+			sqlitex.Execute(conn, "SELECT value FROM setup WHERE key = 'annVectorsMax'", &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					if value := stmt.ColumnInt64(0); value > 0 {
+						annVectorsMax = value
+					}
+					return nil
+				},
+			})
+			candidatesJSON, _ := json.Marshal(candidates)
+			sqlQuery += " WHERE id IN (SELECT value FROM json_each(?)) OR id > ?"
+			sqlArgs = []any{string(candidatesJSON), annVectorsMax}
 		}
 	}
 
@@ -300,7 +413,8 @@ func (h *DBHandler) SearchVectors(query string, limit int) ([]SearchResult, erro
 		var buf []byte
 		var floatBuf []float32
 
-		err := sqlitex.ExecuteTransient(conn, sqlQuery, &sqlitex.ExecOptions{
+		err := sqlitex.Execute(conn, sqlQuery, &sqlitex.ExecOptions{
+			Args: sqlArgs,
 			ResultFunc: func(stmt *sqlite.Stmt) error {
 				ID := stmt.ColumnInt64(0)
 				blobLen := stmt.ColumnLen(1)
@@ -321,7 +435,7 @@ func (h *DBHandler) SearchVectors(query string, limit int) ([]SearchResult, erro
 
 				similarity := dot(queryEmbedding, floatBuf[:floatsLen])
 
-				if len(topResults) < limit {
+				if len(topResults) < vectorsLimit {
 					topResults = append(topResults, VectorDistance{ID: ID, Distance: similarity})
 				} else {
 					minIndex := -1
@@ -348,36 +462,58 @@ func (h *DBHandler) SearchVectors(query string, limit int) ([]SearchResult, erro
 		return topResults[i].Distance > topResults[j].Distance
 	})
 
-	var results []SearchResult
-	for _, vd := range topResults {
-		sqlQuery := `
-			SELECT
-				a.id,
-				a.title,
-				s.content
-			FROM articles a
-			JOIN sections s ON a.id = s.article_id
-			WHERE s.id = ?
-		`
-
-		var result SearchResult
-		var sectionContent string
-		err := sqlitex.ExecuteTransient(conn, sqlQuery, &sqlitex.ExecOptions{
-			Args: []any{vd.ID},
-			ResultFunc: func(stmt *sqlite.Stmt) error {
-				result.ArticleID = int(stmt.ColumnInt64(0))
-				result.Title = stmt.ColumnText(1)
-				sectionContent = stmt.ColumnText(2)
-				return nil
-			},
-		})
+	var highlights map[int64][2]int
+	if h.chunkTokens > 0 {
+		var err error
+		topResults, highlights, err = h.passageSections(conn, topResults, annExplain, limit)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		result.Text = sectionContent
-		result.Snippet = Snippet(sectionContent)
-		result.Type = "V"
+	sectionIDs := make([]int64, len(topResults))
+	for i, vd := range topResults {
+		sectionIDs[i] = vd.ID
+	}
+	sectionIDsJSON, _ := json.Marshal(sectionIDs)
+
+	sections := make(map[int64]SearchResult, len(topResults))
+	err := sqlitex.Execute(conn, `
+		SELECT
+			s.id,
+			a.id,
+			a.title,
+			s.content,
+			s.content_flate,
+			s.title
+		FROM json_each(?) j
+		JOIN sections s ON s.id = j.value
+		JOIN articles a ON a.id = s.article_id`, &sqlitex.ExecOptions{
+		Args: []any{string(sectionIDsJSON)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			content := sectionContent(stmt, 3)
+			sections[stmt.ColumnInt64(0)] = SearchResult{
+				ArticleID:    int(stmt.ColumnInt64(1)),
+				SectionID:    int(stmt.ColumnInt64(0)),
+				Title:        stmt.ColumnText(2),
+				SectionTitle: stmt.ColumnText(5),
+				Text:         content,
+				Snippet:      Snippet(content),
+				Type:         "V",
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for _, vd := range topResults {
+		result, ok := sections[vd.ID]
+		if !ok {
+			continue
+		}
 
 		affinity := (float64(vd.Distance) + 1.0) / 2.0 * 100.0
 		if affinity < 0 {
@@ -386,16 +522,86 @@ func (h *DBHandler) SearchVectors(query string, limit int) ([]SearchResult, erro
 			affinity = 100
 		}
 		result.Power = affinity
+		if highlight, ok := highlights[vd.ID]; ok {
+			result.Highlights = [][2]int{highlight}
+		}
+		if explain {
+			cosine := float64(vd.Distance)
+			result.Explain = &SearchExplain{Cosine: &cosine, Ann: annExplain[vd.ID]}
+		}
 
 		results = append(results, result)
 	}
 
-	log.Printf("Search vector: %s (%v)", query, time.Since(start))
+	log.Printf("Search vector: %d results (%v)", len(results), time.Since(start))
+	searchStage(ctx, "vectors", h.name, start, len(results))
 	return results, nil
 }
 
-func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorDistance, error) {
-	conn := h.pool.Get(context.Background())
+// passageSections replaces the passage vectors, sorted by similarity, with
+// the sections containing them, each one with the similarity and text range
+// of its best passage, and moves the ANN explanations to the sections.
+func (h *DBHandler) passageSections(conn *sqlite.Conn, topResults []VectorDistance, annExplain map[int64]*SearchExplainAnn, limit int) ([]VectorDistance, map[int64][2]int, error) {
+	passageIDs := make([]int64, len(topResults))
+	for i, vd := range topResults {
+		passageIDs[i] = vd.ID
+	}
+	passageIDsJSON, _ := json.Marshal(passageIDs)
+
+	type passage struct {
+		section int64
+		start   int
+		end     int
+	}
+	passages := make(map[int64]passage, len(topResults))
+	err := sqlitex.Execute(conn, `
+		SELECT p.id, p.section_id, p.text_start, p.text_end
+		FROM json_each(?) j
+		JOIN passages p ON p.id = j.value`, &sqlitex.ExecOptions{
+		Args: []any{string(passageIDsJSON)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			passages[stmt.ColumnInt64(0)] = passage{
+				section: stmt.ColumnInt64(1),
+				start:   int(stmt.ColumnInt64(2)),
+				end:     int(stmt.ColumnInt64(3)),
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sections []VectorDistance
+	highlights := make(map[int64][2]int)
+	sectionsAnn := make(map[int64]*SearchExplainAnn)
+	for _, vd := range topResults {
+		p, ok := passages[vd.ID]
+		if !ok {
+			continue
+		}
+		if _, ok := highlights[p.section]; ok {
+			continue
+		}
+		highlights[p.section] = [2]int{p.start, p.end}
+		if ann, ok := annExplain[vd.ID]; ok {
+			sectionsAnn[p.section] = ann
+		}
+		sections = append(sections, VectorDistance{ID: p.section, Distance: vd.Distance})
+		if len(sections) == limit {
+			break
+		}
+	}
+
+	clear(annExplain)
+	for id, ann := range sectionsAnn {
+		annExplain[id] = ann
+	}
+	return sections, highlights, nil
+}
+
+func (h *DBHandler) SearchAnn(ctx context.Context, vectors []float32, size int, limit int) ([]VectorDistance, error) {
+	conn := h.pool.Get(ctx)
 	if conn == nil {
 		return nil, fmt.Errorf("failed to get connection")
 	}
@@ -405,7 +611,7 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 	chunkSize := size * 4
 
 	var tableExists bool
-	sqlitex.ExecuteTransient(conn, "SELECT name FROM sqlite_master WHERE type='table' AND name='vectors_ann_centroids'", &sqlitex.ExecOptions{
+	sqlitex.Execute(conn, "SELECT name FROM sqlite_master WHERE type='table' AND name='vectors_ann_centroids'", &sqlitex.ExecOptions{
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			tableExists = true
 			return nil
@@ -414,7 +620,7 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 
 	var centroidsCount int
 	if tableExists {
-		sqlitex.ExecuteTransient(conn, "SELECT COUNT(*) FROM vectors_ann_centroids", &sqlitex.ExecOptions{
+		sqlitex.Execute(conn, "SELECT COUNT(*) FROM vectors_ann_centroids", &sqlitex.ExecOptions{
 			ResultFunc: func(stmt *sqlite.Stmt) error {
 				centroidsCount = int(stmt.ColumnInt64(0))
 				return nil
@@ -427,6 +633,8 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 	l2Norm(mrlQuery)
 
 	var queryStr string
+	var queryArgs []any
+	chunkCentroids := make(map[int64]int)
 	if centroidsCount > 0 {
 		centroidStart := time.Now()
 
@@ -435,7 +643,7 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 			centroid []float32
 		}
 		var centroids []centroidItem
-		err := sqlitex.ExecuteTransient(conn, "SELECT id, centroid FROM vectors_ann_centroids", &sqlitex.ExecOptions{
+		err := sqlitex.Execute(conn, "SELECT id, centroid FROM vectors_ann_centroids", &sqlitex.ExecOptions{
 			ResultFunc: func(stmt *sqlite.Stmt) error {
 				cBytes := make([]byte, stmt.ColumnLen(1))
 				stmt.ColumnBytes(1, cBytes)
@@ -470,6 +678,28 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 			targetCount = VectorsPerCentroid * 50
 		}
 
+		type centroidChunk struct {
+			id    int64
+			count int
+		}
+		centroidChunks := make(map[int][]centroidChunk)
+		err = sqlitex.Execute(conn, `
+			SELECT cc.centroid_id, cc.chunk_id, length(c.chunk)
+			FROM vectors_ann_centroid_chunks cc
+			JOIN vectors_ann_chunks c ON c.id = cc.chunk_id`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				centroidID := int(stmt.ColumnInt64(0))
+				centroidChunks[centroidID] = append(centroidChunks[centroidID], centroidChunk{
+					id:    stmt.ColumnInt64(1),
+					count: int(stmt.ColumnInt64(2)) / chunkSize,
+				})
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
 		var selectedChunkIDs []int64
 		accumulatedVectors := 0
 		centroidsAdded := 0
@@ -478,32 +708,10 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 				break
 			}
 
-			var currentCentroidChunkIDs []int64
-			err = sqlitex.ExecuteTransient(conn, "SELECT chunk_id FROM vectors_ann_centroid_chunks WHERE centroid_id = ?", &sqlitex.ExecOptions{
-				Args: []any{cd.id},
-				ResultFunc: func(stmt *sqlite.Stmt) error {
-					currentCentroidChunkIDs = append(currentCentroidChunkIDs, stmt.ColumnInt64(0))
-					return nil
-				},
-			})
-			if err != nil {
-				return nil, err
-			}
-
-			for _, chunkID := range currentCentroidChunkIDs {
-				var count int
-				err = sqlitex.ExecuteTransient(conn, "SELECT COUNT(*) FROM vectors_ann_index WHERE chunk_id = ?", &sqlitex.ExecOptions{
-					Args: []any{chunkID},
-					ResultFunc: func(stmt *sqlite.Stmt) error {
-						count = int(stmt.ColumnInt64(0))
-						return nil
-					},
-				})
-				if err != nil {
-					return nil, err
-				}
-				accumulatedVectors += count
-				selectedChunkIDs = append(selectedChunkIDs, chunkID)
+			for _, chunk := range centroidChunks[cd.id] {
+				accumulatedVectors += chunk.count
+				selectedChunkIDs = append(selectedChunkIDs, chunk.id)
+				chunkCentroids[chunk.id] = cd.id
 			}
 			centroidsAdded++
 		}
@@ -514,18 +722,17 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 			return nil, nil
 		}
 
-		var selectedChunkIDsStr []string
-		for _, cid := range selectedChunkIDs {
-			selectedChunkIDsStr = append(selectedChunkIDsStr, strconv.FormatInt(cid, 10))
-		}
-		queryStr = "SELECT id, chunk FROM vectors_ann_chunks WHERE id IN (" + strings.Join(selectedChunkIDsStr, ",") + ")"
+		selectedChunkIDsJSON, _ := json.Marshal(selectedChunkIDs)
+		queryStr = "SELECT id, chunk FROM vectors_ann_chunks WHERE id IN (SELECT value FROM json_each(?))"
+		queryArgs = []any{string(selectedChunkIDsJSON)}
 	} else {
 		queryStr = "SELECT id, chunk FROM vectors_ann_chunks"
 	}
 
 	var topAnnResults []VectorDistance
 
-	err := sqlitex.ExecuteTransient(conn, queryStr, &sqlitex.ExecOptions{
+	err := sqlitex.Execute(conn, queryStr, &sqlitex.ExecOptions{
+		Args: queryArgs,
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			chunkRowID := stmt.ColumnInt64(0)
 			chunkBlob := make([]byte, stmt.ColumnLen(1))
@@ -538,6 +745,7 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 				topAnnResults = append(topAnnResults, VectorDistance{
 					ChunkRowID:    chunkRowID,
 					ChunkPosition: position / chunkSize,
+					Centroid:      chunkCentroids[chunkRowID],
 					Distance:      dot(mrlQuery, storedMRL),
 				})
 			}
@@ -551,6 +759,7 @@ func (h *DBHandler) SearchAnn(vectors []float32, size int, limit int) ([]VectorD
 	sort.Slice(topAnnResults, func(i, j int) bool {
 		return topAnnResults[i].Distance > topAnnResults[j].Distance
 	})
+	searchStage(ctx, "ann", h.name, start, len(topAnnResults))
 
 	if limit > 0 && len(topAnnResults) > limit {
 		topAnnResults = topAnnResults[:limit]
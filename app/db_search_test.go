@@ -0,0 +1,310 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// The search benchmarks run on a generated database of
+// WIKILITE_BENCH_SECTIONS sections (1M by default), five per article, each
+// with 40 words out of a 20k words vocabulary and a 64 dimensions vector
+// drawn around one of 400 clusters. The database is built once in the
+// temporary directory and reused by the following runs:
+//
+//	go test -run '^$' -bench . ./app
+const (
+	benchSectionsPerArticle = 5
+	benchWordsPerSection    = 40
+	benchVocabulary         = 20000
+	benchDimensions         = 64
+	benchClusters           = 400
+	benchLimit              = 10
+)
+
+var (
+	benchOnce    sync.Once
+	benchHandler *DBHandler
+	benchErr     error
+	benchQueries = []string{"wa17", "wb230", "wc1451", "wd9", "we12000", "wf700", "wg3333", "wh42", "wi18000", "wj5"}
+)
+
+func benchWord(i int) string {
+	return fmt.Sprintf("w%c%d", 'a'+i%10, i)
+}
+
+func benchDB(b *testing.B) *DBHandler {
+	b.Helper()
+	benchOnce.Do(func() {
+		log.SetOutput(io.Discard)
+		if options == nil {
+			options = &Config{aiAnnSize: benchDimensions, searchFusion: "rrf", searchRRFK: 60}
+		}
+
+		sections := 1000000
+		if value := os.Getenv("WIKILITE_BENCH_SECTIONS"); value != "" {
+			if sections, benchErr = strconv.Atoi(value); benchErr != nil {
+				return
+			}
+		}
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("wikilite-bench-%d.db", sections))
+		if _, err := os.Stat(path); err != nil {
+			os.Remove(path + ".tmp")
+			if benchErr = benchBuild(path+".tmp", sections); benchErr != nil {
+				return
+			}
+			if benchErr = os.Rename(path+".tmp", path); benchErr != nil {
+				return
+			}
+		}
+		benchHandler, benchErr = openDBHandler(path, true, false)
+	})
+	if benchErr != nil {
+		b.Fatal(benchErr)
+	}
+	return benchHandler
+}
+
+func benchCenters() [][]float32 {
+	rng := rand.New(rand.NewSource(1))
+	centers := make([][]float32, benchClusters)
+	for i := range centers {
+		centers[i] = make([]float32, benchDimensions)
+		for j := range centers[i] {
+			centers[i][j] = float32(rng.NormFloat64())
+		}
+		l2Norm(centers[i])
+	}
+	return centers
+}
+
+func benchVector(rng *rand.Rand, centers [][]float32) []float32 {
+	vector := append([]float32{}, centers[rng.Intn(len(centers))]...)
+	for i := 0; i < 8; i++ {
+		vector[rng.Intn(benchDimensions)] += float32(rng.NormFloat64() * 0.3)
+	}
+	l2Norm(vector)
+	return vector
+}
+
+func benchBuild(path string, sections int) error {
+	h, err := openDBHandler(path, false, false)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	conn := h.writer.Get(context.Background())
+	if conn == nil {
+		return fmt.Errorf("failed to get connection")
+	}
+	rng := rand.New(rand.NewSource(2))
+	centers := benchCenters()
+	err = func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		words := make([]string, benchWordsPerSection)
+		for id := 1; id <= sections/benchSectionsPerArticle; id++ {
+			err = sqlitex.Execute(conn, "INSERT INTO articles (id, title, entity) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+				Args: []any{id, fmt.Sprintf("Article %s %d", benchWord(rng.Intn(benchVocabulary)), id), fmt.Sprintf("Q%d", id)},
+			})
+			if err != nil {
+				return err
+			}
+			for s := 0; s < benchSectionsPerArticle; s++ {
+				for i := range words {
+					words[i] = benchWord(rng.Intn(benchVocabulary))
+				}
+				err = sqlitex.Execute(conn, "INSERT INTO sections (article_id, title, content) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{id, fmt.Sprintf("Section %d", s), strings.Join(words, " ")},
+				})
+				if err != nil {
+					return err
+				}
+				err = sqlitex.Execute(conn, "INSERT INTO vectors (id, embedding) VALUES (?, ?)", &sqlitex.ExecOptions{
+					Args: []any{conn.LastInsertRowID(), Float32ToBytes(benchVector(rng, centers))},
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}()
+	h.writer.Put(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range [][2]string{{"model", "bench"}, {"language", "en"}} {
+		if err := h.SetupPut(key[0], key[1]); err != nil {
+			return err
+		}
+	}
+	if err := h.ProcessTitles(); err != nil {
+		return err
+	}
+	if err := h.ProcessContents(); err != nil {
+		return err
+	}
+	return h.ProcessANN()
+}
+
+// benchSearchTitlePerRow is the title search before the set-based queries,
+// reading the first section of every hit with its own query.
+func benchSearchTitlePerRow(h *DBHandler, query string, limit int) (int, error) {
+	conn := h.pool.Get(context.Background())
+	defer h.pool.Put(conn)
+
+	var ids []int64
+	err := sqlitex.ExecuteTransient(conn, `
+		SELECT rowid, title, snippet(article_search, 0, '<mark>', '</mark>', '...', 16), bm25(article_search) AS power
+		FROM article_search WHERE article_search MATCH ? ORDER BY power ASC LIMIT ?`, &sqlitex.ExecOptions{
+		Args: []any{sanitizeFTSQuery(query, ""), limit},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			ids = append(ids, stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	for _, id := range ids {
+		sqlitex.ExecuteTransient(conn, "SELECT content FROM sections WHERE article_id = ? ORDER BY id LIMIT 1", &sqlitex.ExecOptions{
+			Args:       []any{id},
+			ResultFunc: func(stmt *sqlite.Stmt) error { return nil },
+		})
+	}
+	return len(ids), err
+}
+
+// benchSearchContentPerRow is the content search before the set-based
+// queries, reading content_flate of every hit with its own query.
+func benchSearchContentPerRow(h *DBHandler, query string, limit int) (int, error) {
+	conn := h.pool.Get(context.Background())
+	defer h.pool.Put(conn)
+
+	var ids []int64
+	err := sqlitex.ExecuteTransient(conn, `
+		SELECT s.id, a.title, s.content, snippet(section_search, 1, '<mark>', '</mark>', '...', 64), bm25(section_search) AS power
+		FROM section_search
+		JOIN sections s ON section_search.rowid = s.id
+		JOIN articles a ON s.article_id = a.id
+		WHERE section_search MATCH ? ORDER BY power LIMIT ?`, &sqlitex.ExecOptions{
+		Args: []any{sanitizeFTSQuery(query, ""), limit},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			ids = append(ids, stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	for _, id := range ids {
+		sqlitex.ExecuteTransient(conn, "SELECT content_flate FROM sections WHERE id = ?", &sqlitex.ExecOptions{
+			Args:       []any{id},
+			ResultFunc: func(stmt *sqlite.Stmt) error { return nil },
+		})
+	}
+	return len(ids), err
+}
+
+func BenchmarkSearchTitle(b *testing.B) {
+	h := benchDB(b)
+	ctx := context.Background()
+	b.Run("set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := h.SearchTitle(ctx, benchQueries[i%len(benchQueries)], benchLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per-row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := benchSearchTitlePerRow(h, benchQueries[i%len(benchQueries)], benchLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSearchContent(b *testing.B) {
+	h := benchDB(b)
+	ctx := context.Background()
+	b.Run("set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := h.SearchContent(ctx, benchQueries[i%len(benchQueries)], benchLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per-row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := benchSearchContentPerRow(h, benchQueries[i%len(benchQueries)], benchLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSearchAnn(b *testing.B) {
+	h := benchDB(b)
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(3))
+	centers := benchCenters()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.SearchAnn(ctx, benchVector(rng, centers), benchDimensions, benchLimit*VectorsAnnRescore); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearchEmbedding(b *testing.B) {
+	h := benchDB(b)
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(3))
+	centers := benchCenters()
+	for i := 0; i < b.N; i++ {
+		results, err := h.SearchEmbedding(ctx, benchVector(rng, centers), benchLimit)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(results) == 0 || math.IsNaN(results[0].Power) {
+			b.Fatal("no embedding results")
+		}
+	}
+}
+
+func BenchmarkArticleGet(b *testing.B) {
+	h := benchDB(b)
+	ctx := context.Background()
+	articles := h.benchCount(b, "articles")
+	for i := 0; i < b.N; i++ {
+		if _, err := h.ArticleGet(ctx, 1+(i*7919)%articles); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func (h *DBHandler) benchCount(b *testing.B, table string) int {
+	conn := h.pool.Get(context.Background())
+	defer h.pool.Put(conn)
+
+	var count int
+	err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM "+table, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			count = int(stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return count
+}
@@ -0,0 +1,136 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const StatsCacheTTL = time.Minute
+
+type statsCacheKey struct {
+	name   string
+	tables bool
+}
+
+type statsCacheItem struct {
+	stats   DBStats
+	expires time.Time
+}
+
+var statsCache struct {
+	sync.Mutex
+	items map[statsCacheKey]statsCacheItem
+}
+
+// Stats counts the rows of the database tables. With tables it also walks
+// every page through dbstat to report the size of each table, which takes
+// long on large databases and is left to the command line.
+func (h *DBHandler) Stats(ctx context.Context, tables bool) (DBStats, error) {
+	stats := DBStats{
+		Setup: map[string]string{},
+	}
+
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return stats, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	start := time.Now()
+
+	counts := []struct {
+		query string
+		value *int
+	}{
+		{"SELECT COUNT(*) FROM articles", &stats.Articles},
+		{"SELECT COUNT(*) FROM sections", &stats.Sections},
+		{"SELECT COUNT(*) FROM sections WHERE content_flate IS NOT NULL", &stats.CompressedSections},
+		{"SELECT COUNT(*) FROM vocabulary", &stats.Vocabulary},
+		{"SELECT COUNT(*) FROM vectors", &stats.Vectors},
+		{"SELECT COALESCE(MAX(length(embedding)), 0) / 4 FROM (SELECT embedding FROM vectors LIMIT 1)", &stats.VectorSize},
+		{"SELECT COUNT(*) FROM vectors_ann_index", &stats.AnnVectors},
+		{"SELECT COUNT(*) FROM vectors_ann_centroids", &stats.Centroids},
+	}
+	for _, count := range counts {
+		err := sqlitex.Execute(conn, count.query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				*count.value = int(stmt.ColumnInt64(0))
+				return nil
+			},
+		})
+		if err != nil {
+			return stats, fmt.Errorf("stats query error: %v", err)
+		}
+	}
+
+	if h.chunkTokens > 0 {
+		err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM passages", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				stats.Passages = int(stmt.ColumnInt64(0))
+				return nil
+			},
+		})
+		if err != nil {
+			return stats, fmt.Errorf("stats query error: %v", err)
+		}
+	}
+
+	stats.Compressed = stats.CompressedSections > 0
+	if stats.Centroids > 0 {
+		stats.ClusterSize = float64(stats.AnnVectors) / float64(stats.Centroids)
+	}
+
+	err := sqlitex.Execute(conn, "SELECT key, CASE WHEN key = 'gguf' THEN '' ELSE value END, length(value) FROM setup ORDER BY key", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			key := stmt.ColumnText(0)
+			if key == "gguf" {
+				stats.ModelSize = stmt.ColumnInt64(2)
+				return nil
+			}
+			stats.Setup[key] = stmt.ColumnText(1)
+			return nil
+		},
+	})
+	if err != nil {
+		return stats, fmt.Errorf("stats setup error: %v", err)
+	}
+
+	stats.Model = stats.Setup["model"]
+	stats.AnnSize = extractNumberFromString(stats.Setup["annSize"])
+
+	err = sqlitex.Execute(conn, "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stats.Size = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return stats, fmt.Errorf("stats size error: %v", err)
+	}
+
+	if tables {
+		stats.Tables = []DBStatsTable{}
+		err = sqlitex.Execute(conn, "SELECT name, SUM(pgsize) AS size FROM dbstat GROUP BY name ORDER BY size DESC", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				stats.Tables = append(stats.Tables, DBStatsTable{
+					Name: stmt.ColumnText(0),
+					Size: stmt.ColumnInt64(1),
+				})
+				return nil
+			},
+		})
+		if err != nil {
+			log.Printf("Stats dbstat unavailable: %v", err)
+		}
+	}
+
+	log.Printf("Stats retrieve: (%v)", time.Since(start))
+	return stats, nil
+}
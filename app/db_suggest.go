@@ -0,0 +1,200 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	SuggestCandidates  = 50
+	SuggestTermsLength = 3
+)
+
+// SuggestTitles returns the titles starting with prefix, read from the sorted
+// title index as typed and capitalized, followed by the titles with a word
+// starting with it. The popularity is the number of sections of the article.
+func (h *DBHandler) SuggestTitles(ctx context.Context, prefix string, limit int) ([]Suggestion, error) {
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	start := time.Now()
+	var suggestions []Suggestion
+	index := make(map[int]int)
+	add := func(stmt *sqlite.Stmt, starts bool) {
+		id := int(stmt.ColumnInt64(0))
+		if _, ok := index[id]; ok {
+			return
+		}
+		index[id] = len(suggestions)
+		suggestions = append(suggestions, Suggestion{Text: stmt.ColumnText(1), Type: "title", ArticleID: id, starts: starts})
+	}
+
+	variants := []string{prefix}
+	if first, size := utf8.DecodeRuneInString(prefix); unicode.IsLower(first) {
+		variants = append(variants, string(unicode.ToUpper(first))+prefix[size:])
+	}
+	for _, variant := range variants {
+		err := sqlitex.Execute(conn, "SELECT id, title FROM articles WHERE title >= ? AND title < ? ORDER BY title LIMIT ?", &sqlitex.ExecOptions{
+			Args: []any{variant, variant + string(utf8.MaxRune), SuggestCandidates},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				add(stmt, true)
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if match := suggestMatch(prefix, h.tokenizer); match != "" {
+		err := sqlitex.Execute(conn, "SELECT rowid, title FROM article_search WHERE article_search MATCH ?"+sqlLimit(SuggestCandidates), &sqlitex.ExecOptions{
+			Args: []any{match},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				add(stmt, false)
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	articleIDs := make([]int, len(suggestions))
+	for i, suggestion := range suggestions {
+		articleIDs[i] = suggestion.ArticleID
+	}
+	articleIDsJSON, _ := json.Marshal(articleIDs)
+	err := sqlitex.Execute(conn, `
+		SELECT s.article_id, COUNT(*)
+		FROM json_each(?) j
+		JOIN sections s ON s.article_id = j.value
+		GROUP BY s.article_id`, &sqlitex.ExecOptions{
+		Args: []any{string(articleIDsJSON)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			suggestions[index[int(stmt.ColumnInt64(0))]].Popularity = stmt.ColumnInt64(1)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	suggestSort(suggestions)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	log.Printf("Suggest titles: %s (%v)", prefix, time.Since(start))
+	return suggestions, nil
+}
+
+// SuggestTerms returns the most frequent vocabulary terms starting with
+// word, once it has SuggestTermsLength characters so the terms to sort by
+// frequency are few. Databases without the vocabulary term index fall back
+// to the first title terms of the FTS vocabulary.
+func (h *DBHandler) SuggestTerms(ctx context.Context, word string, limit int) ([]Suggestion, error) {
+	word = TextNormalize(word)
+	if utf8.RuneCountInString(word) < SuggestTermsLength {
+		return nil, nil
+	}
+
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	start := time.Now()
+	sqlQuery := "SELECT term, frequency FROM vocabulary WHERE term >= ? AND term < ? ORDER BY frequency DESC LIMIT ?"
+	args := []any{word, word + string(utf8.MaxRune), limit}
+	if !h.vocabularyTerms {
+		sqlQuery = "SELECT term, doc FROM article_search_vocabulary WHERE term >= ? AND term < ?" + sqlLimit(max(limit, SuggestCandidates))
+		args = args[:2]
+	}
+
+	var suggestions []Suggestion
+	err := sqlitex.Execute(conn, sqlQuery, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			suggestions = append(suggestions, Suggestion{Text: stmt.ColumnText(0), Type: "term", Popularity: stmt.ColumnInt64(1)})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	suggestSort(suggestions)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	log.Printf("Suggest terms: %s (%v)", word, time.Since(start))
+	return suggestions, nil
+}
+
+// vocabularyTermsIndexed reports whether the vocabulary has the term index
+// sorting the terms by frequency, missing in databases built before it.
+func (h *DBHandler) vocabularyTermsIndexed() bool {
+	conn := h.pool.Get(context.Background())
+	if conn == nil {
+		return false
+	}
+	defer h.pool.Put(conn)
+
+	indexed := false
+	sqlitex.Execute(conn, "SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = 'idx_vocabulary_term'", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			indexed = true
+			return nil
+		},
+	})
+	return indexed
+}
+
+// suggestMatch returns the FTS5 expression matching the titles with all the
+// words of prefix, the last one as a prefix.
+func suggestMatch(prefix string, tokenizer string) string {
+	words := ftsQueryWords(prefix, tokenizer)
+	if len(words) == 0 || tokenizer == "trigram" && utf8.RuneCountInString(words[len(words)-1]) < 3 {
+		return ""
+	}
+
+	var terms []string
+	for _, word := range words {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	if tokenizer != "trigram" && !strings.HasSuffix(prefix, " ") {
+		terms[len(terms)-1] += "*"
+	}
+	return strings.Join(terms, " ")
+}
+
+// suggestSort puts first the titles starting with the prefix, then the most
+// popular and shortest ones.
+func suggestSort(suggestions []Suggestion) {
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.starts != b.starts {
+			return a.starts
+		}
+		if a.Popularity != b.Popularity {
+			return a.Popularity > b.Popularity
+		}
+		return len(a.Text) < len(b.Text)
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// FTSTokenizers are the FTS5 tokenizers built into SQLite. There is no
+// language-aware stemmer among them and the driver cannot register one
+// written in Go, so porter, which only stems English, is used only when
+// chosen explicitly.
+var FTSTokenizers = map[string]string{
+	"unicode61": "unicode61 remove_diacritics 2",
+	"porter":    "porter unicode61 remove_diacritics 2",
+	"trigram":   "trigram remove_diacritics 1",
+}
+
+func FTSTokenizer(name string, language string) (string, error) {
+	if name == "" || name == "auto" {
+		switch language {
+		case "zh", "ja", "ko", "th", "lo", "km", "my", "bo":
+			return "trigram", nil
+		}
+		return "unicode61", nil
+	}
+	if _, ok := FTSTokenizers[name]; !ok {
+		return "", fmt.Errorf("unsupported tokenizer: %q", name)
+	}
+	return name, nil
+}
+
+func (h *DBHandler) ProcessTokenizer(name string) error {
+	name, err := FTSTokenizer(name, options.language)
+	if err != nil {
+		return err
+	}
+
+	conn := h.writer.Get(context.Background())
+	if conn == nil {
+		return fmt.Errorf("failed to get connection")
+	}
+	defer h.writer.Put(conn)
+
+	log.Printf("Setting FTS tokenizer: %s", name)
+
+	tokenize := FTSTokenizers[name]
+	queries := []string{
+		`DROP TABLE IF EXISTS article_search_vocabulary`,
+		`DROP TABLE IF EXISTS section_search_vocabulary`,
+		`DROP TABLE IF EXISTS article_search`,
+		`DROP TABLE IF EXISTS section_search`,
+		`CREATE VIRTUAL TABLE article_search USING fts5(
+			title,
+			content='articles',
+			content_rowid='id',
+			tokenize='` + tokenize + `'
+		)`,
+		`CREATE VIRTUAL TABLE article_search_vocabulary USING fts5vocab(article_search, row)`,
+		`CREATE VIRTUAL TABLE section_search USING fts5(
+			title, content,
+			content='sections',
+			content_rowid='id',
+			tokenize='` + tokenize + `'
+		)`,
+		`CREATE VIRTUAL TABLE section_search_vocabulary USING fts5vocab(section_search, row)`,
+	}
+
+	err = func() error {
+		var err error
+		deferFn := sqlitex.Transaction(conn)
+		defer deferFn(&err)
+
+		for _, query := range queries {
+			if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+				return fmt.Errorf("error creating search tables: %v", err)
+			}
+		}
+		err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO setup (key, value) VALUES ('tokenizer', ?)", &sqlitex.ExecOptions{
+			Args: []any{name},
+		})
+		return err
+	}()
+	if err != nil {
+		return err
+	}
+
+	h.tokenizer = name
+	return nil
+}
+
+func (h *DBHandler) Retokenize(name string) error {
+	start := time.Now()
+
+	conn := h.writer.Get(context.Background())
+	if conn == nil {
+		return fmt.Errorf("failed to get connection")
+	}
+	var compressed bool
+	sqlitex.Execute(conn, "SELECT 1 FROM sections WHERE content IS NULL AND content_flate IS NOT NULL LIMIT 1", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			compressed = true
+			return nil
+		},
+	})
+	h.writer.Put(conn)
+	if compressed {
+		return fmt.Errorf("cannot change the tokenizer of a compressed database")
+	}
+
+	if err := h.ProcessTokenizer(name); err != nil {
+		return err
+	}
+	if err := h.ProcessTitles(); err != nil {
+		return err
+	}
+	if err := h.ProcessContents(); err != nil {
+		return err
+	}
+	if err := h.ProcessVocabulary(); err != nil {
+		return err
+	}
+
+	log.Printf("Tokenizer %s applied in %v", h.tokenizer, time.Since(start))
+	return nil
+}
+
+func ftsQueryWords(query string, tokenizer string) []string {
+	var words []string
+	for _, word := range strings.Fields(query) {
+		if tokenizer == "trigram" && len([]rune(word)) < 3 {
+			continue
+		}
+		words = append(words, word)
+	}
+	if len(words) == 0 {
+		return strings.Fields(query)
+	}
+	return words
+}
@@ -0,0 +1,301 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const TrigramMinSimilarity = 0.3
+
+func (h *DBHandler) ProcessTrigram(scope string) error {
+	if scope != "titles" && scope != "all" {
+		return fmt.Errorf("unsupported trigram scope: %q", scope)
+	}
+
+	conn := h.writer.Get(context.Background())
+	if conn == nil {
+		return fmt.Errorf("failed to get connection")
+	}
+	defer h.writer.Put(conn)
+
+	start := time.Now()
+
+	if scope == "all" {
+		var compressed bool
+		sqlitex.Execute(conn, "SELECT 1 FROM sections WHERE content IS NULL AND content_flate IS NOT NULL LIMIT 1", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				compressed = true
+				return nil
+			},
+		})
+		if compressed {
+			return fmt.Errorf("cannot build the section trigram index of a compressed database")
+		}
+	}
+
+	queries := []string{
+		`DROP TABLE IF EXISTS article_trigram_vocabulary`,
+		`DROP TABLE IF EXISTS article_trigram`,
+		`DROP TABLE IF EXISTS section_trigram`,
+		`CREATE VIRTUAL TABLE article_trigram USING fts5(
+			title,
+			content='articles',
+			content_rowid='id',
+			tokenize='` + FTSTokenizers["trigram"] + `'
+		)`,
+		`INSERT INTO article_trigram(article_trigram) VALUES('rebuild')`,
+		`CREATE VIRTUAL TABLE article_trigram_vocabulary USING fts5vocab(article_trigram, row)`,
+	}
+	if scope == "all" {
+		queries = append(queries,
+			`CREATE VIRTUAL TABLE section_trigram USING fts5(
+				content,
+				content='sections',
+				content_rowid='id',
+				tokenize='`+FTSTokenizers["trigram"]+`'
+			)`,
+			`INSERT INTO section_trigram(section_trigram) VALUES('rebuild')`,
+		)
+	}
+
+	err := func() error {
+		var err error
+		deferFn := sqlitex.Transaction(conn)
+		defer deferFn(&err)
+
+		for _, query := range queries {
+			if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+				return fmt.Errorf("error building trigram index: %v", err)
+			}
+		}
+		err = sqlitex.Execute(conn, "INSERT OR REPLACE INTO setup (key, value) VALUES ('trigram', ?)", &sqlitex.ExecOptions{
+			Args: []any{scope},
+		})
+		return err
+	}()
+	if err != nil {
+		return err
+	}
+
+	h.trigram = scope
+	log.Printf("Trigram index (%s) built in %v", scope, time.Since(start))
+	return nil
+}
+
+func trigramTerms(normalized string) []string {
+	seen := make(map[string]bool)
+	var trigrams []string
+	for _, word := range strings.Fields(normalized) {
+		runes := []rune(word)
+		for i := 0; i+3 <= len(runes); i++ {
+			trigram := string(runes[i : i+3])
+			if !seen[trigram] {
+				seen[trigram] = true
+				trigrams = append(trigrams, trigram)
+			}
+		}
+	}
+	return trigrams
+}
+
+// trigramQuery matches the titles that can reach TrigramMinSimilarity. The
+// Dice similarity 2s/(q+t) of a title of t trigrams sharing s of the q query
+// trigrams is highest when t = s, so it needs s >= q*min/(2-min), and all but
+// the word boundary trigrams, which are not indexed, must be searchable ones.
+// Such a title contains at least one of the rarest searchable trigrams beyond
+// that overlap, so only those are searched.
+func (h *DBHandler) trigramQuery(conn *sqlite.Conn, normalized string) string {
+	trigrams := trigramTerms(normalized)
+	query := len(trigramSet(normalized))
+	boundary := query - len(trigrams)
+	overlap := max(1, int(math.Ceil(float64(query)*TrigramMinSimilarity/(2-TrigramMinSimilarity)))-boundary)
+	if overlap > 1 {
+		docs := make(map[string]int64, len(trigrams))
+		for _, trigram := range trigrams {
+			err := sqlitex.Execute(conn, "SELECT doc FROM article_trigram_vocabulary WHERE term = ?", &sqlitex.ExecOptions{
+				Args: []any{trigram},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					docs[trigram] = stmt.ColumnInt64(0)
+					return nil
+				},
+			})
+			if err != nil {
+				docs = nil
+				break
+			}
+		}
+		if docs != nil {
+			sort.SliceStable(trigrams, func(i, j int) bool {
+				return docs[trigrams[i]] < docs[trigrams[j]]
+			})
+			trigrams = trigrams[:len(trigrams)-overlap+1]
+		}
+	}
+
+	terms := make([]string, len(trigrams))
+	for i, trigram := range trigrams {
+		terms[i] = `"` + strings.ReplaceAll(trigram, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " OR ")
+}
+
+func (h *DBHandler) SearchTitleFuzzy(ctx context.Context, searchQuery string, limit int) ([]SearchResult, error) {
+	normalized := TextNormalize(searchQuery)
+
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	candidates := limit * 20
+	if candidates < 200 {
+		candidates = 200
+	}
+
+	var sqlQuery, match string
+	if h.trigram != "" {
+		match = h.trigramQuery(conn, normalized)
+		sqlQuery = `
+			SELECT rowid, title FROM article_trigram
+			WHERE article_trigram MATCH ?
+			ORDER BY bm25(article_trigram)` + sqlLimit(candidates)
+	} else {
+		var prefixes []string
+		for _, word := range ftsQueryWords(normalized, h.tokenizer) {
+			prefixes = append(prefixes, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+		}
+		match = strings.Join(prefixes, " ")
+		sqlQuery = `
+			SELECT rowid, title FROM article_search
+			WHERE article_search MATCH ?
+			ORDER BY bm25(article_search)` + sqlLimit(candidates)
+	}
+	if match == "" {
+		return nil, nil
+	}
+
+	start := time.Now()
+	explain := searchExplain(ctx)
+	var results []SearchResult
+	err := sqlitex.Execute(conn, sqlQuery, &sqlitex.ExecOptions{
+		Args: []any{match},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			title := stmt.ColumnText(1)
+			similarity := TrigramSimilarity(normalized, title)
+			if titleNormalized := TextNormalize(title); strings.Contains(titleNormalized, normalized) {
+				similarity = max(similarity, float64(len(normalized))/float64(len(titleNormalized)))
+			}
+			if similarity < TrigramMinSimilarity {
+				return nil
+			}
+			result := SearchResult{
+				ArticleID: int(stmt.ColumnInt64(0)),
+				Title:     title,
+				Snippet:   title,
+				Type:      "F",
+				Power:     similarity * 100,
+			}
+			if explain {
+				result.Explain = &SearchExplain{Trigram: &similarity}
+			}
+			results = append(results, result)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Power > results[j].Power
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	articleIDs := make([]int, len(results))
+	for i, result := range results {
+		articleIDs[i] = result.ArticleID
+	}
+	articleIDsJSON, _ := json.Marshal(articleIDs)
+
+	sections := make(map[int]SearchResult, len(results))
+	err = sqlitex.Execute(conn, `
+		SELECT j.value, s.content, s.content_flate, s.id, s.title
+		FROM json_each(?) j
+		JOIN sections s ON s.id = (SELECT MIN(id) FROM sections WHERE article_id = j.value)`, &sqlitex.ExecOptions{
+		Args: []any{string(articleIDsJSON)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			sections[int(stmt.ColumnInt64(0))] = SearchResult{
+				SectionID:    int(stmt.ColumnInt64(3)),
+				SectionTitle: stmt.ColumnText(4),
+				Text:         Snippet(sectionContent(stmt, 1)),
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		section := sections[results[i].ArticleID]
+		results[i].Text = section.Text
+		results[i].SectionID = section.SectionID
+		results[i].SectionTitle = section.SectionTitle
+	}
+
+	if h.trigram == "all" && len([]rune(normalized)) >= 3 {
+		err = sqlitex.Execute(conn, `
+			SELECT
+				s.article_id,
+				a.title,
+				s.content,
+				s.content_flate,
+				bm25(section_trigram) AS power,
+				s.id,
+				s.title
+			FROM section_trigram
+			JOIN sections s ON s.id = section_trigram.rowid
+			JOIN articles a ON a.id = s.article_id
+			WHERE section_trigram MATCH ?
+			ORDER BY power`+sqlLimit(limit), &sqlitex.ExecOptions{
+			Args: []any{`"` + strings.ReplaceAll(normalized, `"`, `""`) + `"`},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				text := sectionContent(stmt, 2)
+				result := SearchResult{
+					ArticleID:    int(stmt.ColumnInt64(0)),
+					SectionID:    int(stmt.ColumnInt64(5)),
+					Title:        stmt.ColumnText(1),
+					SectionTitle: stmt.ColumnText(6),
+					Text:         text,
+					Snippet:      Snippet(text),
+					Type:         "C",
+					Power:        normalizeBM25(stmt.ColumnFloat(4)),
+				}
+				if explain {
+					result.Explain = explainBM25("section_trigram", stmt.ColumnFloat(4))
+				}
+				results = append(results, result)
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Search title fuzzy: %s (%v)", searchQuery, time.Since(start))
+	searchStage(ctx, "fuzzy", h.name, start, len(results))
+	return results, nil
+}
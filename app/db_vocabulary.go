@@ -0,0 +1,230 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	VocabularyMaxDistance  = 2
+	VocabularyPrefixLength = 7
+	vocabularyIndexVersion = "symspell:2:7"
+	vocabularyDeletesBatch = 50000
+)
+
+func vocabularyKey(s string) int64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(s))
+	return int64(hash.Sum32())
+}
+
+// vocabularyDeletes returns the keys of all the strings obtained removing up
+// to VocabularyMaxDistance runes from the word prefix, the word prefix included.
+func vocabularyDeletes(word string) []int64 {
+	runes := []rune(word)
+	if len(runes) > VocabularyPrefixLength {
+		runes = runes[:VocabularyPrefixLength]
+	}
+
+	prefix := string(runes)
+	seen := map[string]bool{prefix: true}
+	keys := []int64{vocabularyKey(prefix)}
+	level := []string{prefix}
+	for distance := 0; distance < VocabularyMaxDistance; distance++ {
+		var next []string
+		for _, item := range level {
+			r := []rune(item)
+			if len(r) <= 1 {
+				continue
+			}
+			for i := range r {
+				deleted := string(r[:i]) + string(r[i+1:])
+				if !seen[deleted] {
+					seen[deleted] = true
+					keys = append(keys, vocabularyKey(deleted))
+					next = append(next, deleted)
+				}
+			}
+		}
+		level = next
+	}
+
+	return keys
+}
+
+func (h *DBHandler) processVocabularyIndex(conn *sqlite.Conn) error {
+	start := time.Now()
+	batchSize := 100000
+
+	queries := []string{
+		`DROP TABLE IF EXISTS temp.vocabulary_deletes_build`,
+		`CREATE TEMP TABLE vocabulary_deletes_build (key INTEGER, length INTEGER, term_id INTEGER)`,
+	}
+	for _, query := range queries {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return fmt.Errorf("error clearing vocabulary index: %v", err)
+		}
+	}
+	defer sqlitex.ExecuteTransient(conn, "DROP TABLE IF EXISTS temp.vocabulary_deletes_build", nil)
+
+	type vocabularyTerm struct {
+		id   int64
+		term string
+	}
+
+	var deletes [][3]int64
+	flush := func() error {
+		if len(deletes) == 0 {
+			return nil
+		}
+		deletesJSON, _ := json.Marshal(deletes)
+		deletes = deletes[:0]
+		err := sqlitex.Execute(conn, `
+			INSERT INTO temp.vocabulary_deletes_build (key, length, term_id)
+			SELECT json_extract(value, '$[0]'), json_extract(value, '$[1]'), json_extract(value, '$[2]') FROM json_each(?)`, &sqlitex.ExecOptions{
+			Args: []any{string(deletesJSON)},
+		})
+		if err != nil {
+			return fmt.Errorf("error populating vocabulary index: %v", err)
+		}
+		return nil
+	}
+
+	var lastID, count int64
+	for {
+		var terms []vocabularyTerm
+		err := sqlitex.Execute(conn, "SELECT rowid, term FROM vocabulary WHERE rowid > ? ORDER BY rowid LIMIT ?", &sqlitex.ExecOptions{
+			Args: []any{lastID, batchSize},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				terms = append(terms, vocabularyTerm{id: stmt.ColumnInt64(0), term: stmt.ColumnText(1)})
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error reading vocabulary: %v", err)
+		}
+
+		for _, term := range terms {
+			length := int64(utf8.RuneCountInString(term.term))
+			for _, key := range vocabularyDeletes(term.term) {
+				deletes = append(deletes, [3]int64{key, length, term.id})
+				count++
+			}
+			if len(deletes) >= vocabularyDeletesBatch {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			lastID = term.id
+		}
+
+		if len(terms) < batchSize {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	queries = []string{
+		`DROP TABLE IF EXISTS vocabulary_deletes`,
+		`CREATE TABLE vocabulary_deletes (key INTEGER, length INTEGER, term_id INTEGER, PRIMARY KEY (key, length, term_id)) WITHOUT ROWID`,
+		`INSERT OR IGNORE INTO vocabulary_deletes SELECT key, length, term_id FROM temp.vocabulary_deletes_build ORDER BY key, length, term_id`,
+	}
+	for _, query := range queries {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return fmt.Errorf("error creating vocabulary index: %v", err)
+		}
+	}
+	err := sqlitex.Execute(conn, "INSERT OR REPLACE INTO setup (key, value) VALUES ('vocabularyIndex', ?)", &sqlitex.ExecOptions{
+		Args: []any{vocabularyIndexVersion},
+	})
+	if err != nil {
+		return err
+	}
+
+	h.vocabularyIndex = vocabularyIndexVersion
+	log.Printf("Vocabulary index: %d deletes in %v", count, time.Since(start))
+	return nil
+}
+
+type vocabularyMatch struct {
+	term      string
+	distance  int
+	frequency int64
+}
+
+func (h *DBHandler) searchVocabularyIndex(ctx context.Context, inputWord string, limit int) ([]SearchResult, error) {
+	matches, err := h.vocabularyMatches(ctx, inputWord, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []SearchResult{}
+	for _, match := range matches {
+		results = append(results, SearchResult{Text: match.term, Power: float64(match.distance)})
+	}
+	return results, nil
+}
+
+// vocabularyMatches returns the terms within VocabularyMaxDistance of
+// inputWord, the closest and then most frequent first.
+func (h *DBHandler) vocabularyMatches(ctx context.Context, inputWord string, limit int) ([]vocabularyMatch, error) {
+	conn := h.pool.Get(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get connection")
+	}
+	defer h.pool.Put(conn)
+
+	start := time.Now()
+	word := TextNormalize(inputWord)
+	length := utf8.RuneCountInString(word)
+	keys, _ := json.Marshal(vocabularyDeletes(word))
+
+	var matches []vocabularyMatch
+	err := sqlitex.Execute(conn, `
+		SELECT v.term, v.frequency
+		FROM vocabulary v
+		WHERE v.rowid IN (
+			SELECT d.term_id FROM json_each(?) j
+			JOIN vocabulary_deletes d ON d.key = j.value AND d.length BETWEEN ? AND ?
+		)`, &sqlitex.ExecOptions{
+		Args: []any{string(keys), length - VocabularyMaxDistance, length + VocabularyMaxDistance},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			term := stmt.ColumnText(0)
+			if distance := LevenshteinDistanceMax(word, term, VocabularyMaxDistance); distance <= VocabularyMaxDistance {
+				matches = append(matches, vocabularyMatch{term: term, distance: distance, frequency: stmt.ColumnInt64(1)})
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		if matches[i].frequency != matches[j].frequency {
+			return matches[i].frequency > matches[j].frequency
+		}
+		return matches[i].term < matches[j].term
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	log.Printf("Search word distance: %s (%v)", inputWord, time.Since(start))
+	return matches, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math"
 	"math/bits"
+	"strings"
 )
 
 func EuclideanDistance(a, b []float32) (float32, error) {
@@ -73,3 +74,65 @@ func LevenshteinDistance(s1, s2 string) int {
 
 	return dp[len1][len2]
 }
+
+// LevenshteinDistanceMax returns maxDistance+1 as soon as the distance
+// between the two strings is known to exceed maxDistance.
+func LevenshteinDistanceMax(s1, s2 string, maxDistance int) int {
+	r1, r2 := []rune(s1), []rune(s2)
+	len1, len2 := len(r1), len(r2)
+	if len1-len2 > maxDistance || len2-len1 > maxDistance {
+		return maxDistance + 1
+	}
+
+	prev := make([]int, len2+1)
+	curr := make([]int, len2+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len1; i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len2; j++ {
+			if r1[i-1] == r2[j-1] {
+				curr[j] = prev[j-1]
+			} else {
+				curr[j] = min(prev[j-1], curr[j-1], prev[j]) + 1
+			}
+			rowMin = min(rowMin, curr[j])
+		}
+		if rowMin > maxDistance {
+			return maxDistance + 1
+		}
+		prev, curr = curr, prev
+	}
+
+	return min(prev[len2], maxDistance+1)
+}
+
+func trigramSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(s) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			set[string(runes[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+func TrigramSimilarity(s1, s2 string) float64 {
+	t1, t2 := trigramSet(TextNormalize(s1)), trigramSet(TextNormalize(s2))
+	if len(t1) == 0 || len(t2) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for trigram := range t1 {
+		if t2[trigram] {
+			shared++
+		}
+	}
+
+	return 2 * float64(shared) / float64(len(t1)+len(t2))
+}
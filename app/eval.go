@@ -0,0 +1,359 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EvalQuery struct {
+	Query string   `json:"query"`
+	IDs   []string `json:"ids"`
+}
+
+type EvalEngine struct {
+	Engine  string             `json:"engine"`
+	Queries int                `json:"queries"`
+	Recall  map[string]float64 `json:"recall"`
+	NDCG    map[string]float64 `json:"ndcg"`
+	MRR     float64            `json:"mrr"`
+	Time    float64            `json:"time"`
+}
+
+type EvalAnn struct {
+	Queries int                `json:"queries"`
+	Recall  map[string]float64 `json:"recall"`
+	Time    float64            `json:"time"`
+	Exact   float64            `json:"exact_time"`
+}
+
+type EvalReport struct {
+	Database string            `json:"database"`
+	Queries  int               `json:"queries"`
+	K        []int             `json:"k"`
+	Setup    map[string]string `json:"setup"`
+	Engines  []EvalEngine      `json:"engines"`
+	Ann      *EvalAnn          `json:"ann,omitempty"`
+}
+
+type searchExactKey struct{}
+
+// withSearchExact makes the embeddings search scan all the vectors instead of the ANN index.
+func withSearchExact(ctx context.Context) context.Context {
+	return context.WithValue(ctx, searchExactKey{}, true)
+}
+
+// EvalCutoffs parses the comma separated ranks at which recall and nDCG are measured.
+func EvalCutoffs(value string) ([]int, error) {
+	var cutoffs []int
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		k, err := strconv.Atoi(item)
+		if err != nil || k <= 0 {
+			return nil, fmt.Errorf("invalid evaluation cutoff: %q", item)
+		}
+		if !slices.Contains(cutoffs, k) {
+			cutoffs = append(cutoffs, k)
+		}
+	}
+	if len(cutoffs) == 0 {
+		return nil, fmt.Errorf("no evaluation cutoffs")
+	}
+	sort.Ints(cutoffs)
+	return cutoffs, nil
+}
+
+// EvalQrels reads the relevance judgments of path, as JSON lines or query<TAB>ids.
+func EvalQrels(path string) ([]EvalQuery, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening qrels file: %v", err)
+	}
+	defer file.Close()
+
+	var queries []EvalQuery
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var query EvalQuery
+		if strings.HasPrefix(text, "{") {
+			var item struct {
+				Query string            `json:"query"`
+				IDs   []json.RawMessage `json:"ids"`
+			}
+			if err := json.Unmarshal([]byte(text), &item); err != nil {
+				return nil, fmt.Errorf("error parsing qrels line %d: %v", line, err)
+			}
+			query.Query = item.Query
+			for _, id := range item.IDs {
+				query.IDs = append(query.IDs, strings.Trim(string(id), `"`))
+			}
+		} else {
+			value, ids, found := strings.Cut(text, "\t")
+			if !found {
+				return nil, fmt.Errorf("error parsing qrels line %d: missing tab between query and IDs", line)
+			}
+			query.Query = strings.TrimSpace(value)
+			query.IDs = strings.FieldsFunc(ids, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})
+		}
+
+		for _, id := range query.IDs {
+			if _, _, err := ArticleRefParse(id); err != nil {
+				return nil, fmt.Errorf("error parsing qrels line %d: %v", line, err)
+			}
+		}
+		if query.Query == "" || len(query.IDs) == 0 {
+			return nil, fmt.Errorf("error parsing qrels line %d: query and IDs are required", line)
+		}
+		queries = append(queries, query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading qrels file: %v", err)
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries in qrels file")
+	}
+
+	return queries, nil
+}
+
+// Evaluate writes the recall, nDCG and MRR of each search mode over the qrels queries.
+func Evaluate(ctx context.Context, path string, cutoffs []int, ann bool, format string, w io.Writer) error {
+	queries, err := EvalQrels(path)
+	if err != nil {
+		return err
+	}
+	depth := cutoffs[len(cutoffs)-1]
+	settings := SearchSettingsDefault()
+
+	report := EvalReport{
+		Database: options.dbPath,
+		Queries:  len(queries),
+		K:        cutoffs,
+		Setup: map[string]string{
+			"model":        options.aiModel,
+			"annSize":      strconv.Itoa(options.aiAnnSize),
+			"chunkTokens":  strconv.Itoa(db.chunkTokens),
+			"prefixSearch": options.aiModelPrefixSearch,
+			"fusion":       options.searchFusion,
+			"rrfK":         strconv.FormatFloat(options.searchRRFK, 'g', -1, 64),
+			"weights":      options.searchWeights,
+		},
+	}
+
+	engines := []struct {
+		name   string
+		search func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error)
+	}{
+		{"title", searchUnranked(SearchTitle)},
+		{"lexical", SearchLexical},
+		{"semantic", searchUnranked(SearchSemantic)},
+		{"combined", Search},
+	}
+	for _, engine := range engines {
+		if engine.name == "semantic" && !ai {
+			continue
+		}
+		result := EvalEngine{
+			Engine:  engine.name,
+			Queries: len(queries),
+			Recall:  make(map[string]float64),
+			NDCG:    make(map[string]float64),
+		}
+
+		start := time.Now()
+		for _, query := range queries {
+			results, err := engine.search(ctx, query.Query, settings, depth)
+			if err != nil {
+				return fmt.Errorf("error evaluating %s search of %q: %v", engine.name, query.Query, err)
+			}
+			ranking := evalRanking(results, depth)
+
+			for _, k := range cutoffs {
+				recall, ndcg := evalScores(ranking, query.IDs, k)
+				result.Recall[strconv.Itoa(k)] += recall / float64(len(queries))
+				result.NDCG[strconv.Itoa(k)] += ndcg / float64(len(queries))
+			}
+			for i, ref := range ranking {
+				if slices.Contains(query.IDs, ref) {
+					result.MRR += 1 / float64(i+1) / float64(len(queries))
+					break
+				}
+			}
+		}
+		result.Time = time.Since(start).Seconds() / float64(len(queries))
+		report.Engines = append(report.Engines, result)
+	}
+
+	if ann {
+		if report.Ann, err = evalAnn(ctx, queries, cutoffs); err != nil {
+			return err
+		}
+	}
+
+	if format == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	return report.write(w)
+}
+
+// evalRanking returns the distinct article references of results by decreasing power.
+func evalRanking(results []SearchResult, depth int) []string {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Power > results[j].Power
+	})
+
+	var ranking []string
+	for _, result := range results {
+		if ref := result.Ref(); !slices.Contains(ranking, ref) {
+			ranking = append(ranking, ref)
+		}
+		if len(ranking) == depth {
+			break
+		}
+	}
+	return ranking
+}
+
+// evalScores returns the recall and the binary relevance nDCG at k of ranking.
+func evalScores(ranking []string, relevant []string, k int) (float64, float64) {
+	var found int
+	var dcg, ideal float64
+	for i := 0; i < k; i++ {
+		if i < len(ranking) && slices.Contains(relevant, ranking[i]) {
+			found++
+			dcg += 1 / math.Log2(float64(i+2))
+		}
+		if i < len(relevant) {
+			ideal += 1 / math.Log2(float64(i+2))
+		}
+	}
+	return float64(found) / float64(len(relevant)), dcg / ideal
+}
+
+// evalAnn compares the sections found through the ANN index with an exact scan.
+func evalAnn(ctx context.Context, queries []EvalQuery, cutoffs []int) (*EvalAnn, error) {
+	if !ai {
+		return nil, fmt.Errorf("ANN evaluation requires the embedding model")
+	}
+	for _, h := range federatedHandlers() {
+		if !h.AiHasANN() || !h.AiHasVectors() {
+			return nil, fmt.Errorf("ANN evaluation requires both ANN index and vectors")
+		}
+	}
+
+	depth := cutoffs[len(cutoffs)-1]
+	report := &EvalAnn{Queries: len(queries), Recall: make(map[string]float64)}
+	var annTime, exactTime time.Duration
+	for _, query := range queries {
+		embedding, err := aiQueryEmbeddings(ctx, query.Query)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		approximate, err := evalSections(ctx, embedding, depth)
+		if err != nil {
+			return nil, err
+		}
+		annTime += time.Since(start)
+
+		start = time.Now()
+		exact, err := evalSections(withSearchExact(ctx), embedding, depth)
+		if err != nil {
+			return nil, err
+		}
+		exactTime += time.Since(start)
+
+		for _, k := range cutoffs {
+			recall := 1.0
+			if len(exact) > 0 {
+				recall, _ = evalScores(approximate, exact[:min(k, len(exact))], k)
+			}
+			report.Recall[strconv.Itoa(k)] += recall / float64(len(queries))
+		}
+	}
+	report.Time = annTime.Seconds() / float64(len(queries))
+	report.Exact = exactTime.Seconds() / float64(len(queries))
+
+	return report, nil
+}
+
+func evalSections(ctx context.Context, embedding []float32, depth int) ([]string, error) {
+	results, err := federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+		if h.model != "" && h.model != options.aiModel {
+			return nil, nil
+		}
+		return h.SearchEmbedding(ctx, embedding, depth)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Power > results[j].Power
+	})
+	var sections []string
+	for _, result := range results[:min(depth, len(results))] {
+		sections = append(sections, result.SectionRef())
+	}
+	return sections, nil
+}
+
+func (r EvalReport) write(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Database: %s, %d queries, model %s, ANN size %s, fusion %s\n\n", r.Database, r.Queries, r.Setup["model"], r.Setup["annSize"], r.Setup["fusion"]))
+
+	sb.WriteString(fmt.Sprintf("%-10s", "engine"))
+	for _, k := range r.K {
+		sb.WriteString(fmt.Sprintf(" %9s", fmt.Sprintf("recall@%d", k)))
+	}
+	for _, k := range r.K {
+		sb.WriteString(fmt.Sprintf(" %9s", fmt.Sprintf("ndcg@%d", k)))
+	}
+	sb.WriteString(fmt.Sprintf(" %9s %9s\n", "mrr", "time"))
+
+	for _, engine := range r.Engines {
+		sb.WriteString(fmt.Sprintf("%-10s", engine.Engine))
+		for _, k := range r.K {
+			sb.WriteString(fmt.Sprintf(" %9.3f", engine.Recall[strconv.Itoa(k)]))
+		}
+		for _, k := range r.K {
+			sb.WriteString(fmt.Sprintf(" %9.3f", engine.NDCG[strconv.Itoa(k)]))
+		}
+		sb.WriteString(fmt.Sprintf(" %9.3f %8.1fms\n", engine.MRR, engine.Time*1000))
+	}
+
+	if r.Ann != nil {
+		sb.WriteString("\nANN recall against exact vectors:")
+		for _, k := range r.K {
+			sb.WriteString(fmt.Sprintf(" @%d %.3f", k, r.Ann.Recall[strconv.Itoa(k)]))
+		}
+		sb.WriteString(fmt.Sprintf(", %.1fms against %.1fms\n", r.Ann.Time*1000, r.Ann.Exact*1000))
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
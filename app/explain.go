@@ -0,0 +1,117 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type searchTrace struct {
+	mu      sync.Mutex
+	timings []SearchTiming
+}
+
+type searchTraceKey struct{}
+
+// WithSearchTrace returns a context collecting the time spent by every
+// search stage, read back with SearchTimings, and asking the engines to
+// explain the scores of their results.
+func WithSearchTrace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, searchTraceKey{}, &searchTrace{})
+}
+
+func SearchTimings(ctx context.Context) []SearchTiming {
+	trace, ok := ctx.Value(searchTraceKey{}).(*searchTrace)
+	if !ok {
+		return nil
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	return append([]SearchTiming{}, trace.timings...)
+}
+
+// searchExplain reports whether the results searched with ctx should carry
+// their explanation.
+func searchExplain(ctx context.Context) bool {
+	_, ok := ctx.Value(searchTraceKey{}).(*searchTrace)
+	return ok
+}
+
+// searchStage records the time spent since start by a search stage, when the
+// context collects a trace.
+func searchStage(ctx context.Context, stage string, source string, start time.Time, results int) {
+	trace, ok := ctx.Value(searchTraceKey{}).(*searchTrace)
+	if !ok {
+		return
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	trace.timings = append(trace.timings, SearchTiming{
+		Stage:   stage,
+		Source:  source,
+		Results: results,
+		Time:    time.Since(start).Seconds(),
+	})
+}
+
+func explainBM25(table string, score float64) *SearchExplain {
+	return &SearchExplain{BM25: map[string]float64{table: score}}
+}
+
+// merge copies the engine scores of other missing from e.
+func (e *SearchExplain) merge(other *SearchExplain) {
+	if other == nil {
+		return
+	}
+	for table, score := range other.BM25 {
+		if _, ok := e.BM25[table]; !ok {
+			if e.BM25 == nil {
+				e.BM25 = make(map[string]float64)
+			}
+			e.BM25[table] = score
+		}
+	}
+	if e.Trigram == nil {
+		e.Trigram = other.Trigram
+	}
+	if e.Cosine == nil {
+		e.Cosine = other.Cosine
+	}
+	if e.Ann == nil {
+		e.Ann = other.Ann
+	}
+}
+
+// String formats the explanation on one line for the CLI.
+func (e *SearchExplain) String() string {
+	var parts []string
+	tables := make([]string, 0, len(e.BM25))
+	for table := range e.BM25 {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		parts = append(parts, fmt.Sprintf("bm25 %s=%.3f", table, e.BM25[table]))
+	}
+	if e.Trigram != nil {
+		parts = append(parts, fmt.Sprintf("trigram=%.3f", *e.Trigram))
+	}
+	if e.Cosine != nil {
+		parts = append(parts, fmt.Sprintf("cosine=%.4f", *e.Cosine))
+	}
+	if e.Ann != nil {
+		parts = append(parts, fmt.Sprintf("ann centroid=%d rank=%d/%d similarity=%.4f", e.Ann.Centroid, e.Ann.Rank, e.Ann.Candidates, e.Ann.Similarity))
+	}
+	for _, fusion := range e.Fusion {
+		parts = append(parts, fmt.Sprintf("%s #%d power=%.2f weight=%g +%.2f", fusion.Engine, fusion.Rank, fusion.Power, fusion.Weight, fusion.Contribution))
+	}
+	if e.Rerank != nil {
+		parts = append(parts, fmt.Sprintf("rerank=%.4f", *e.Rerank))
+	}
+	return strings.Join(parts, ", ")
+}
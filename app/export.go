@@ -0,0 +1,362 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ExportFormats = map[string]string{
+	"md":    "text/markdown; charset=utf-8",
+	"html":  "text/html; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+	"epub":  "application/epub+zip",
+}
+
+func ExportFormat(format string, path string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case "markdown":
+		format = "md"
+	case "htm":
+		format = "html"
+	case "json":
+		format = "jsonl"
+	}
+	if _, ok := ExportFormats[format]; !ok {
+		return "", fmt.Errorf("unsupported export format: %q", format)
+	}
+	return format, nil
+}
+
+func ExportArticles(ctx context.Context, refs []string, titles []string, query string, limit int) ([]ArticleResult, error) {
+	var articles []ArticleResult
+	seen := make(map[string]bool)
+
+	add := func(ref string) error {
+		article, err := ArticleGet(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("article %s: %w", ref, err)
+		}
+		if seen[article.Ref()] {
+			return nil
+		}
+		seen[article.Ref()] = true
+		articles = append(articles, article)
+		return nil
+	}
+
+	for _, ref := range refs {
+		if err := add(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, title := range titles {
+		title = strings.TrimSpace(title)
+		if title == "" {
+			continue
+		}
+		ref, err := ArticleFind(ctx, title, "")
+		if err != nil {
+			return nil, fmt.Errorf("article %q: %w", title, err)
+		}
+		if err := add(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	if query != "" {
+		results, err := Search(ctx, query, SearchSettingsDefault(), limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if err := add(result.Ref()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(articles) == 0 {
+		return nil, fmt.Errorf("no articles to export: %w", ErrArticleNotFound)
+	}
+
+	return articles, nil
+}
+
+func Export(w io.Writer, format string, articles []ArticleResult) error {
+	switch format {
+	case "md":
+		return exportMarkdown(w, articles)
+	case "html":
+		return exportHTML(w, articles)
+	case "jsonl":
+		return exportJSONL(w, articles)
+	case "epub":
+		return exportEPUB(w, articles)
+	}
+	return fmt.Errorf("unsupported export format: %q", format)
+}
+
+func ExportFile(path string, format string, articles []ArticleResult) error {
+	start := time.Now()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating export file: %v", err)
+	}
+
+	if err := Export(file, format, articles); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing export file: %v", err)
+	}
+
+	log.Printf("Exported %d articles to %s (%v)", len(articles), path, time.Since(start))
+	return nil
+}
+
+func exportTitle(articles []ArticleResult) string {
+	if len(articles) == 1 {
+		return articles[0].Title
+	}
+	return fmt.Sprintf("%s - %d articles", Name, len(articles))
+}
+
+func exportParagraphs(content string) []string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(content, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+		}
+	}
+	return paragraphs
+}
+
+func exportMarkdown(w io.Writer, articles []ArticleResult) error {
+	var sb strings.Builder
+	for i, article := range articles {
+		if i > 0 {
+			sb.WriteString("\n---\n\n")
+		}
+		sb.WriteString(fmt.Sprintf("# %s\n\n", article.Title))
+		for _, section := range article.Sections {
+			if section.Title != "" {
+				sb.WriteString(fmt.Sprintf("## %s\n\n", strings.TrimSpace(section.Title)))
+			}
+			for _, paragraph := range exportParagraphs(section.Content) {
+				sb.WriteString(paragraph)
+				sb.WriteString("\n\n")
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func exportJSONL(w io.Writer, articles []ArticleResult) error {
+	encoder := json.NewEncoder(w)
+	for _, article := range articles {
+		if err := encoder.Encode(article); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportArticleBody(sb *strings.Builder, article ArticleResult, heading string) {
+	for _, section := range article.Sections {
+		if section.Title != "" {
+			sb.WriteString(fmt.Sprintf("<%s id=\"%s\">%s</%s>\n", heading, exportAnchor("s", section.ID, article.Source), html.EscapeString(strings.TrimSpace(section.Title)), heading))
+		}
+		for _, paragraph := range exportParagraphs(section.Content) {
+			lines := strings.Split(html.EscapeString(paragraph), "\n")
+			sb.WriteString("<p>" + strings.Join(lines, "<br/>\n") + "</p>\n")
+		}
+	}
+}
+
+// exportAnchor returns the HTML id of an article or section, with its source
+// so the IDs of federated databases do not collide.
+func exportAnchor(prefix string, id int, source string) string {
+	anchor := prefix + strconv.Itoa(id)
+	if source != "" {
+		anchor += "-" + strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+				return r
+			}
+			return '_'
+		}, source)
+	}
+	return anchor
+}
+
+func exportHTML(w io.Writer, articles []ArticleResult) error {
+	var sb strings.Builder
+	title := html.EscapeString(exportTitle(articles))
+
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	sb.WriteString("<title>" + title + "</title>\n")
+	sb.WriteString("<style>body{max-width:50em;margin:auto;padding:1em;font-family:serif;line-height:1.5}</style>\n")
+	sb.WriteString("</head>\n<body>\n")
+
+	if len(articles) > 1 {
+		sb.WriteString("<nav>\n<ol>\n")
+		for _, article := range articles {
+			sb.WriteString(fmt.Sprintf("<li><a href=\"#%s\">%s</a></li>\n", exportAnchor("a", article.ID, article.Source), html.EscapeString(article.Title)))
+		}
+		sb.WriteString("</ol>\n</nav>\n")
+	}
+
+	for _, article := range articles {
+		sb.WriteString(fmt.Sprintf("<article id=\"%s\">\n<h1>%s</h1>\n", exportAnchor("a", article.ID, article.Source), html.EscapeString(article.Title)))
+		exportArticleBody(&sb, article, "h2")
+		sb.WriteString("</article>\n")
+	}
+
+	sb.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func exportEPUB(w io.Writer, articles []ArticleResult) error {
+	type epubFile struct {
+		name    string
+		content string
+	}
+
+	zw := zip.NewWriter(w)
+
+	title := html.EscapeString(exportTitle(articles))
+	bookID := fmt.Sprintf("urn:%s:%d", Name, time.Now().UnixNano())
+	language := html.EscapeString(options.language)
+
+	mimetype, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return err
+	}
+
+	files := []epubFile{
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+</rootfiles>
+</container>
+`},
+	}
+
+	var manifest, spine, nav, ncx strings.Builder
+	playOrder := 0
+	for i, article := range articles {
+		name := fmt.Sprintf("article%d.xhtml", i+1)
+		articleTitle := html.EscapeString(article.Title)
+
+		var body strings.Builder
+		body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><meta charset="utf-8"/><title>` + articleTitle + `</title></head>
+<body>
+<h1>` + articleTitle + "</h1>\n")
+		exportArticleBody(&body, article, "h2")
+		body.WriteString("</body>\n</html>\n")
+		files = append(files, epubFile{"OEBPS/" + name, body.String()})
+
+		manifest.WriteString(fmt.Sprintf("<item id=\"a%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, name))
+		spine.WriteString(fmt.Sprintf("<itemref idref=\"a%d\"/>\n", i+1))
+
+		playOrder++
+		nav.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a>", name, articleTitle))
+		ncx.WriteString(fmt.Sprintf("<navPoint id=\"n%d\" playOrder=\"%d\"><navLabel><text>%s</text></navLabel><content src=\"%s\"/>\n", playOrder, playOrder, articleTitle, name))
+
+		var sections []ArticleResultSection
+		for _, section := range article.Sections {
+			if strings.TrimSpace(section.Title) != "" {
+				sections = append(sections, section)
+			}
+		}
+		if len(sections) > 0 {
+			nav.WriteString("\n<ol>\n")
+			for _, section := range sections {
+				sectionTitle := html.EscapeString(strings.TrimSpace(section.Title))
+				playOrder++
+				nav.WriteString(fmt.Sprintf("<li><a href=\"%s#%s\">%s</a></li>\n", name, exportAnchor("s", section.ID, article.Source), sectionTitle))
+				ncx.WriteString(fmt.Sprintf("<navPoint id=\"n%d\" playOrder=\"%d\"><navLabel><text>%s</text></navLabel><content src=\"%s#%s\"/></navPoint>\n", playOrder, playOrder, sectionTitle, name, exportAnchor("s", section.ID, article.Source)))
+			}
+			nav.WriteString("</ol>\n")
+		}
+		nav.WriteString("</li>\n")
+		ncx.WriteString("</navPoint>\n")
+	}
+
+	files = append(files, epubFile{"OEBPS/nav.xhtml", `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><meta charset="utf-8"/><title>` + title + `</title></head>
+<body>
+<nav epub:type="toc" id="toc">
+<h1>` + title + `</h1>
+<ol>
+` + nav.String() + `</ol>
+</nav>
+</body>
+</html>
+`}, epubFile{"OEBPS/toc.ncx", `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head><meta name="dtb:uid" content="` + bookID + `"/></head>
+<docTitle><text>` + title + `</text></docTitle>
+<navMap>
+` + ncx.String() + `</navMap>
+</ncx>
+`}, epubFile{"OEBPS/content.opf", `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="bookid">` + bookID + `</dc:identifier>
+<dc:title>` + title + `</dc:title>
+<dc:language>` + language + `</dc:language>
+<dc:publisher>` + Name + `</dc:publisher>
+<meta property="dcterms:modified">` + time.Now().UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+` + manifest.String() + `</manifest>
+<spine toc="ncx">
+` + spine.String() + `</spine>
+</package>
+`})
+
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, file.content); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,214 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func FederatedOpen(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	dbs = []*DBHandler{db}
+	names := make(map[string]bool)
+	for i, path := range append([]string{options.dbPath}, paths...) {
+		if i > 0 {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("federated database not found: %s", path)
+			}
+			handler, err := openDBHandler(path, true, false)
+			if err != nil {
+				return fmt.Errorf("error opening federated database %s: %v", path, err)
+			}
+			dbs = append(dbs, handler)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		for n := 2; names[name] || name == ""; n++ {
+			name = fmt.Sprintf("%s-%d", strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), n)
+		}
+		names[name] = true
+		dbs[i].name = name
+
+		if dbs[i].model != "" && dbs[i].model != options.aiModel {
+			log.Printf("Federated database %s uses model %s, semantic search disabled for it", name, dbs[i].model)
+		}
+	}
+
+	log.Printf("Federated search across %d databases", len(dbs))
+	return nil
+}
+
+func FederatedClose() {
+	for i, h := range dbs {
+		if i > 0 {
+			h.Close()
+		}
+	}
+}
+
+func federatedHandlers() []*DBHandler {
+	if len(dbs) == 0 {
+		return []*DBHandler{db}
+	}
+	return dbs
+}
+
+func federatedSearch(searchFunc func(h *DBHandler) ([]SearchResult, error)) ([]SearchResult, error) {
+	handlers := federatedHandlers()
+	if len(handlers) == 1 {
+		return searchFunc(handlers[0])
+	}
+
+	resultSets := make([][]SearchResult, len(handlers))
+	errs := make([]error, len(handlers))
+	var wg sync.WaitGroup
+	for i, h := range handlers {
+		wg.Add(1)
+		go func(i int, h *DBHandler) {
+			defer wg.Done()
+			resultSets[i], errs[i] = searchFunc(h)
+			for j := range resultSets[i] {
+				resultSets[i][j].Source = h.name
+			}
+		}(i, h)
+	}
+	wg.Wait()
+
+	var results []SearchResult
+	for i := range handlers {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s: %v", handlers[i].name, errs[i])
+		}
+		results = append(results, resultSets[i]...)
+	}
+	return results, nil
+}
+
+func ArticleRef(source string, id int) string {
+	if source == "" {
+		return strconv.Itoa(id)
+	}
+	return source + ":" + strconv.Itoa(id)
+}
+
+func (r SearchResult) Ref() string {
+	return ArticleRef(r.Source, r.ArticleID)
+}
+
+// SectionRef identifies the section of a result, it is the article
+// reference followed by the section anchor.
+func (r SearchResult) SectionRef() string {
+	return r.Ref() + "#section-" + strconv.Itoa(r.SectionID)
+}
+
+func (a ArticleResult) Ref() string {
+	return ArticleRef(a.Source, a.ID)
+}
+
+func ArticleRefParse(ref string) (*DBHandler, int, error) {
+	handler := db
+	value := strings.TrimSpace(ref)
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		source := value[:i]
+		value = value[i+1:]
+		handler = nil
+		for _, h := range federatedHandlers() {
+			if h.name == source {
+				handler = h
+				break
+			}
+		}
+		if handler == nil {
+			return nil, 0, fmt.Errorf("unknown article source: %s", source)
+		}
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid article id: %s", ref)
+	}
+	return handler, id, nil
+}
+
+func ArticleGet(ctx context.Context, ref string) (ArticleResult, error) {
+	handler, id, err := ArticleRefParse(ref)
+	if err != nil {
+		return ArticleResult{}, err
+	}
+
+	article, err := handler.ArticleGet(ctx, id)
+	if err != nil {
+		return article, err
+	}
+	article.Source = handler.name
+
+	return article, nil
+}
+
+func ArticleFind(ctx context.Context, title string, entity string) (string, error) {
+	for _, h := range federatedHandlers() {
+		var id int
+		var err error
+		if entity != "" {
+			id, err = h.ArticleIDByEntity(ctx, entity)
+		} else {
+			id, err = h.ArticleIDByTitle(ctx, title)
+		}
+		if err == nil {
+			return ArticleRef(h.name, id), nil
+		}
+	}
+	return "", ErrArticleNotFound
+}
+
+func ArticleLanguage(article ArticleResult) string {
+	if handler, _, err := ArticleRefParse(article.Ref()); err == nil && handler.language != "" {
+		return handler.language
+	}
+	return options.language
+}
+
+// FederatedStats returns the statistics of every database, tagged with their
+// source when there are several. Counting all the rows takes a while on large
+// databases, so the statistics of each one are computed at most once every
+// StatsCacheTTL, and the table sizes only when asked.
+func FederatedStats(ctx context.Context, tables bool) ([]DBStats, error) {
+	statsCache.Lock()
+	defer statsCache.Unlock()
+
+	if statsCache.items == nil {
+		statsCache.items = make(map[statsCacheKey]statsCacheItem)
+	}
+
+	handlers := federatedHandlers()
+	var stats []DBStats
+	for _, h := range handlers {
+		key := statsCacheKey{name: h.name, tables: tables}
+		cached, ok := statsCache.items[key]
+		if !ok || time.Now().After(cached.expires) {
+			item, err := h.Stats(ctx, tables)
+			if err != nil {
+				return nil, err
+			}
+			if len(handlers) > 1 {
+				item.Source = h.name
+			}
+			cached = statsCacheItem{stats: item, expires: time.Now().Add(StatsCacheTTL)}
+			statsCache.items[key] = cached
+		}
+		stats = append(stats, cached.stats)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,231 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SearchEngines = map[string]string{
+	"title":    "T",
+	"content":  "C",
+	"fuzzy":    "F",
+	"semantic": "V",
+}
+
+var searchEngineOrder = []string{"T", "C", "F", "V"}
+
+type SearchSettings struct {
+	Fusion  string
+	RRFK    float64
+	Weights map[string]float64
+	Rerank  bool
+	Group   string
+}
+
+func SearchSettingsDefault() SearchSettings {
+	weights, _ := SearchWeightsParse(options.searchWeights, nil)
+	return SearchSettings{
+		Fusion:  options.searchFusion,
+		RRFK:    options.searchRRFK,
+		Weights: weights,
+		Group:   "article",
+	}
+}
+
+// SearchWeightsParse reads engine weights such as "title=2,semantic=0.5"
+// on top of base, engines not listed keep their base weight or 1.
+func SearchWeightsParse(value string, base map[string]float64) (map[string]float64, error) {
+	weights := make(map[string]float64, len(SearchEngines))
+	for engine := range SearchEngines {
+		weights[engine] = 1
+		if weight, ok := base[engine]; ok {
+			weights[engine] = weight
+		}
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, number, found := strings.Cut(item, "=")
+		if !found {
+			name, number, found = strings.Cut(item, ":")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := SearchEngines[name]; !ok || !found {
+			return nil, fmt.Errorf("invalid search weight: %q", item)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid search weight: %q", item)
+		}
+		weights[name] = weight
+	}
+
+	return weights, nil
+}
+
+func (s SearchSettings) Validate() error {
+	switch s.Fusion {
+	case "rrf", "weighted":
+	default:
+		return fmt.Errorf("unsupported search fusion: %q", s.Fusion)
+	}
+	if s.RRFK <= 0 {
+		return fmt.Errorf("invalid rrf k: %v", s.RRFK)
+	}
+	if s.Group != "article" && s.Group != "section" {
+		return fmt.Errorf("unsupported search group: %q", s.Group)
+	}
+	if s.Rerank && !aiRerankReady() {
+		return fmt.Errorf("reranker model not loaded")
+	}
+	return nil
+}
+
+func (s SearchSettings) weight(resultType string) float64 {
+	for engine, engineType := range SearchEngines {
+		if engineType == resultType {
+			if weight, ok := s.Weights[engine]; ok {
+				return weight
+			}
+		}
+	}
+	return 1
+}
+
+// key identifies the results merged by the fusion: the article, or the
+// section when grouping by section.
+func (s SearchSettings) key(result SearchResult) string {
+	if s.Group == "section" {
+		return result.SectionRef()
+	}
+	return result.Ref()
+}
+
+// searchFuse combines the ranks of every engine into one power per article or section.
+func searchFuse(ctx context.Context, results []SearchResult, settings SearchSettings, limit int) []SearchResult {
+	start := time.Now()
+	byType := make(map[string][]SearchResult)
+	var fused []SearchResult
+	index := make(map[string]int)
+	for _, result := range results {
+		byType[result.Type] = append(byType[result.Type], result)
+		if _, ok := index[settings.key(result)]; !ok {
+			index[settings.key(result)] = len(fused)
+			fused = append(fused, result)
+		}
+	}
+
+	types := append([]string{}, searchEngineOrder...)
+	for resultType := range byType {
+		if !slices.Contains(searchEngineOrder, resultType) && resultType != "" {
+			types = append(types, resultType)
+		}
+	}
+	sort.Strings(types[len(searchEngineOrder):])
+
+	scores := make([]float64, len(fused))
+	var explains []*SearchExplain
+	if searchExplain(ctx) {
+		explains = make([]*SearchExplain, len(fused))
+		for i := range explains {
+			explains[i] = &SearchExplain{}
+		}
+	}
+	var total float64
+	for _, resultType := range types {
+		list := byType[resultType]
+		weight := settings.weight(resultType)
+		if len(list) == 0 || weight == 0 {
+			continue
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Power > list[j].Power
+		})
+
+		maxPower := list[0].Power
+		seen := make(map[string]bool)
+		rank := 0
+		for _, result := range list {
+			ref := settings.key(result)
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			rank++
+
+			var score float64
+			switch settings.Fusion {
+			case "weighted":
+				normalized := 1.0
+				if maxPower > 0 {
+					normalized = result.Power / maxPower
+				}
+				score = weight * normalized
+			default:
+				score = weight / (settings.RRFK + float64(rank))
+			}
+			scores[index[ref]] += score
+
+			if explains != nil {
+				explains[index[ref]].merge(result.Explain)
+				explains[index[ref]].Fusion = append(explains[index[ref]].Fusion, SearchExplainFusion{
+					Engine:       searchEngineName(resultType),
+					Rank:         rank,
+					Power:        result.Power,
+					Weight:       weight,
+					Contribution: score,
+				})
+			}
+		}
+
+		if settings.Fusion == "weighted" {
+			total += weight
+		} else {
+			total += weight / (settings.RRFK + 1)
+		}
+	}
+
+	var output []SearchResult
+	for i, result := range fused {
+		if scores[i] <= 0 {
+			continue
+		}
+		result.Power = scores[i] / total * 100
+		if explains != nil {
+			for j := range explains[i].Fusion {
+				explains[i].Fusion[j].Contribution = explains[i].Fusion[j].Contribution / total * 100
+			}
+			result.Explain = explains[i]
+		}
+		output = append(output, result)
+	}
+
+	sort.SliceStable(output, func(i, j int) bool {
+		return output[i].Power > output[j].Power
+	})
+	if len(output) > limit {
+		output = output[:limit]
+	}
+
+	searchStage(ctx, "fusion", "", start, len(output))
+	return output
+}
+
+func searchEngineName(resultType string) string {
+	for engine, engineType := range SearchEngines {
+		if engineType == resultType {
+			return engine
+		}
+	}
+	return resultType
+}
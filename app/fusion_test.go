@@ -0,0 +1,164 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestSearchFuse(t *testing.T) {
+	rrf := func(ranks ...int) float64 {
+		var score float64
+		for _, rank := range ranks {
+			score += 1 / (60 + float64(rank))
+		}
+		return score
+	}
+	weights := map[string]float64{"title": 1, "content": 1, "fuzzy": 1, "semantic": 1}
+
+	tests := []struct {
+		name     string
+		settings SearchSettings
+		results  []SearchResult
+		want     map[string]float64
+		engines  map[string]int
+	}{
+		{
+			name:     "first everywhere",
+			settings: SearchSettings{Fusion: "rrf", RRFK: 60, Weights: weights, Group: "article"},
+			results: []SearchResult{
+				{ArticleID: 1, Type: "T", Power: 9},
+				{ArticleID: 1, Type: "V", Power: 0.8},
+			},
+			want:    map[string]float64{"1": 100},
+			engines: map[string]int{"1": 2},
+		},
+		{
+			name:     "rrf",
+			settings: SearchSettings{Fusion: "rrf", RRFK: 60, Weights: weights, Group: "article"},
+			results: []SearchResult{
+				{ArticleID: 1, Type: "T", Power: 9},
+				{ArticleID: 2, Type: "C", Power: 7},
+				{ArticleID: 1, Type: "C", Power: 5},
+			},
+			want: map[string]float64{
+				"1": rrf(1, 2) / rrf(1, 1) * 100,
+				"2": rrf(1) / rrf(1, 1) * 100,
+			},
+			engines: map[string]int{"1": 2, "2": 1},
+		},
+		{
+			name:     "weighted",
+			settings: SearchSettings{Fusion: "weighted", RRFK: 60, Weights: map[string]float64{"title": 2, "content": 1, "fuzzy": 1, "semantic": 1}, Group: "article"},
+			results: []SearchResult{
+				{ArticleID: 1, Type: "T", Power: 10},
+				{ArticleID: 2, Type: "T", Power: 5},
+				{ArticleID: 2, Type: "C", Power: 4},
+			},
+			want: map[string]float64{
+				"1": 2.0 / 3 * 100,
+				"2": (2*0.5 + 1) / 3 * 100,
+			},
+			engines: map[string]int{"1": 1, "2": 2},
+		},
+		{
+			name:     "disabled engine",
+			settings: SearchSettings{Fusion: "rrf", RRFK: 60, Weights: map[string]float64{"title": 1, "content": 1, "fuzzy": 1, "semantic": 0}, Group: "article"},
+			results: []SearchResult{
+				{ArticleID: 1, Type: "T", Power: 9},
+				{ArticleID: 2, Type: "V", Power: 0.9},
+			},
+			want:    map[string]float64{"1": 100},
+			engines: map[string]int{"1": 1},
+		},
+		{
+			name:     "unknown type",
+			settings: SearchSettings{Fusion: "rrf", RRFK: 60, Weights: weights, Group: "article"},
+			results: []SearchResult{
+				{ArticleID: 1, Type: "T", Power: 9},
+				{ArticleID: 2, Type: "X", Power: 3},
+			},
+			want: map[string]float64{
+				"1": 50,
+				"2": 50,
+			},
+			engines: map[string]int{"1": 1, "2": 1},
+		},
+		{
+			name:     "duplicate results",
+			settings: SearchSettings{Fusion: "rrf", RRFK: 60, Weights: weights, Group: "article"},
+			results: []SearchResult{
+				{ArticleID: 1, SectionID: 10, Type: "C", Power: 9},
+				{ArticleID: 1, SectionID: 11, Type: "C", Power: 8},
+				{ArticleID: 2, SectionID: 20, Type: "C", Power: 7},
+			},
+			want: map[string]float64{
+				"1": 100,
+				"2": rrf(2) / rrf(1) * 100,
+			},
+			engines: map[string]int{"1": 1, "2": 1},
+		},
+		{
+			name:     "sections",
+			settings: SearchSettings{Fusion: "rrf", RRFK: 60, Weights: weights, Group: "section"},
+			results: []SearchResult{
+				{ArticleID: 1, SectionID: 10, Type: "C", Power: 9},
+				{ArticleID: 1, SectionID: 11, Type: "C", Power: 8},
+			},
+			want: map[string]float64{
+				"1#section-10": 100,
+				"1#section-11": rrf(2) / rrf(1) * 100,
+			},
+			engines: map[string]int{"1#section-10": 1, "1#section-11": 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fused := searchFuse(WithSearchTrace(context.Background()), test.results, test.settings, 10)
+			if len(fused) != len(test.want) {
+				t.Fatalf("searchFuse returned %d results, want %d", len(fused), len(test.want))
+			}
+			for i, result := range fused {
+				key := test.settings.key(result)
+				want, ok := test.want[key]
+				if !ok {
+					t.Errorf("unexpected result %s", key)
+					continue
+				}
+				if math.Abs(result.Power-want) > 1e-9 {
+					t.Errorf("result %s power = %v, want %v", key, result.Power, want)
+				}
+				if i > 0 && result.Power > fused[i-1].Power {
+					t.Errorf("result %s ranked after a lower power", key)
+				}
+				if result.Explain == nil || len(result.Explain.Fusion) != test.engines[key] {
+					t.Errorf("result %s explain = %+v, want %d engines", key, result.Explain, test.engines[key])
+				}
+			}
+		})
+	}
+}
+
+func TestSearchFuseLimit(t *testing.T) {
+	settings := SearchSettings{Fusion: "rrf", RRFK: 60, Weights: map[string]float64{"title": 1}, Group: "article"}
+	var results []SearchResult
+	for id := 1; id <= 5; id++ {
+		results = append(results, SearchResult{ArticleID: id, Type: "T", Power: float64(10 - id)})
+	}
+
+	fused := searchFuse(context.Background(), results, settings, 3)
+	if len(fused) != 3 {
+		t.Fatalf("searchFuse returned %d results, want 3", len(fused))
+	}
+	for i, result := range fused {
+		if result.ArticleID != i+1 {
+			t.Errorf("result %d is article %d, want %d", i, result.ArticleID, i+1)
+		}
+		if result.Explain != nil {
+			t.Errorf("result %d explained without a trace", i)
+		}
+	}
+}
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"runtime"
+	"strings"
 )
 
 const Name = "wikilite"
@@ -21,21 +24,52 @@ type Config struct {
 	aiApiKey            string
 	aiApiUrl            string
 	aiCache             bool
+	aiChunkOverlap      int
+	aiChunkTokens       int
 	aiModel             string
 	aiModelImport       string
 	aiModelPrefixSave   string
 	aiModelPrefixSearch string
+	aiRerankModel       string
+	aiRerankTop         int
 	aiThreads           int
 	aiSync              bool
+	cacheEmbeddings     int
+	cachePath           string
+	cacheSize           int
+	cacheTtl            int
 	cli                 bool
 	dbPath              string
 	dbCompress          bool
+	dbFederated         []string
+	dbMerge             string
+	dbTokenizer         string
+	dbTrigram           string
+	dbWal               bool
+	eval                string
+	evalAnn             bool
+	evalFormat          string
+	evalK               string
+	export              string
+	exportFormat        string
+	exportIDs           string
+	exportQuery         string
+	exportTitles        string
 	help                bool
 	language            string
 	limit               int
 	log                 bool
 	logFile             string
+	publish             string
+	publishName         string
+	publishSize         int
+	searchFusion        string
+	searchPassage       string
+	searchRRFK          float64
+	searchTimeout       int
+	searchWeights       string
 	setup               bool
+	stats               bool
 	web                 bool
 	webBrowser          bool
 	webHost             string
@@ -48,6 +82,7 @@ type Config struct {
 var (
 	ai      bool
 	db      *DBHandler
+	dbs     []*DBHandler
 	options *Config
 )
 
@@ -59,23 +94,56 @@ func parseConfig() (*Config, error) {
 	flag.StringVar(&options.aiApiKey, "ai-api-key", "", "AI API key")
 	flag.StringVar(&options.aiApiUrl, "ai-api-url", "http://localhost:8080/v1/embeddings", "AI API url")
 	flag.BoolVar(&options.aiCache, "ai-cache", false, "Keep AI model tensors in RAM for quicker embedding generation")
+	flag.IntVar(&options.aiChunkOverlap, "ai-chunk-overlap", 64, "Tokens shared by consecutive embedding passages")
+	flag.IntVar(&options.aiChunkTokens, "ai-chunk-tokens", 0, "Maximum tokens of the section passages embedded separately, 0 embeds whole sections")
 	flag.StringVar(&options.aiModel, "ai-model", "Qwen3-Embedding-0.6B-Q8_0", "AI embedding model name")
 	flag.StringVar(&options.aiModelImport, "ai-model-import", "", "Import AI model from file path")
 	flag.StringVar(&options.aiModelPrefixSave, "ai-model-prefix-save", "", "AI embedding model task prefix to import a document")
 	flag.StringVar(&options.aiModelPrefixSearch, "ai-model-prefix-search", "Instruct: Given a web search query, retrieve relevant passages that answer the query\nQuery:", "AI embedding model task prefix to perform a search")
+	flag.StringVar(&options.aiRerankModel, "ai-rerank-model", "", "Reranker GGUF model file path, such as Qwen3-Reranker-0.6B-Q8_0, for rerank=true searches")
+	flag.IntVar(&options.aiRerankTop, "ai-rerank-top", 10, "Number of top search results scored by the reranker")
 	flag.IntVar(&options.aiThreads, "ai-threads", 0, "Embedding generation threads (default all)")
 	flag.BoolVar(&options.aiSync, "ai-sync", false, "Generate embeddings")
 
+	flag.IntVar(&options.cacheEmbeddings, "cache-embeddings", 10000, "Maximum number of query embeddings kept in the persistent cache, 0 to disable")
+	flag.StringVar(&options.cachePath, "cache-path", "", "Query embeddings cache database path (default the database path with .cache.db extension)")
+	flag.IntVar(&options.cacheSize, "cache-size", 256, "Maximum number of searches kept in the memory results cache, 0 to disable")
+	flag.IntVar(&options.cacheTtl, "cache-ttl", 300, "Results cache entries lifetime in seconds, 0 to keep them until evicted")
+
 	flag.BoolVar(&options.cli, "cli", false, "Interactive CLI search")
 
-	flag.StringVar(&options.dbPath, "db", "wikilite.db", "SQLite database path")
+	flag.StringVar(&options.dbPath, "db", "wikilite.db", "SQLite database path, comma separated paths for federated search")
 	flag.BoolVar(&options.dbCompress, "db-compress", false, "Compress the database")
+	flag.StringVar(&options.dbMerge, "db-merge", "", "Merge another wikilite database into the current one")
+	flag.StringVar(&options.dbTokenizer, "db-tokenizer", "", "Full-text search tokenizer: unicode61, porter (English stemming) or trigram (default trigram for languages without spaces, unicode61 otherwise)")
+	flag.StringVar(&options.dbTrigram, "db-trigram", "", "Build a trigram index for fuzzy search over titles or all (titles and sections)")
+	flag.BoolVar(&options.dbWal, "db-wal", false, "Use WAL journal to keep serving searches while importing or generating embeddings")
+
+	flag.StringVar(&options.eval, "eval", "", "Evaluate the searches against a qrels file of queries and relevant article IDs")
+	flag.BoolVar(&options.evalAnn, "eval-ann", false, "Also measure the ANN recall against an exact scan of the vectors")
+	flag.StringVar(&options.evalFormat, "eval-format", "table", "Evaluation report format: table or json")
+	flag.StringVar(&options.evalK, "eval-k", "1,5,10", "Comma separated ranks of the evaluation recall and nDCG")
+
+	flag.StringVar(&options.export, "export", "", "Export articles to file path")
+	flag.StringVar(&options.exportFormat, "export-format", "", "Export format: md, html, jsonl or epub (default from file extension)")
+	flag.StringVar(&options.exportIDs, "export-ids", "", "Comma separated article IDs to export")
+	flag.StringVar(&options.exportQuery, "export-query", "", "Search query selecting the articles to export")
+	flag.StringVar(&options.exportTitles, "export-titles", "", "Pipe separated article titles to export")
 
 	flag.StringVar(&options.language, "language", "en", "Language code")
 	flag.IntVar(&options.limit, "limit", 10, "Maximum number of search results")
 	flag.BoolVar(&options.log, "log", false, "Enable logging")
 	flag.StringVar(&options.logFile, "log-file", "", "Log file path")
+	flag.StringVar(&options.publish, "publish", "", "Split the database into gzip parts and manifest inside this directory")
+	flag.StringVar(&options.publishName, "publish-name", "", "Published database name (default database file name)")
+	flag.IntVar(&options.publishSize, "publish-size", 2048, "Published part maximum size in MB")
+	flag.StringVar(&options.searchFusion, "search-fusion", "rrf", "Search results fusion: rrf (reciprocal rank) or weighted (normalized power)")
+	flag.StringVar(&options.searchPassage, "search-passage", "lexical", "Semantic results passage scoring: lexical (query words overlap) or embedding (sentence embeddings, slower)")
+	flag.Float64Var(&options.searchRRFK, "search-rrf-k", 60, "Reciprocal rank fusion k constant")
+	flag.IntVar(&options.searchTimeout, "search-timeout", 0, "Search deadline in seconds for each web, MCP or CLI request (default none)")
+	flag.StringVar(&options.searchWeights, "search-weights", "", "Comma separated search engine weights, for example title=1,content=1,fuzzy=0.5,semantic=1")
 	flag.BoolVar(&options.setup, "setup", false, "Download prebuild database")
+	flag.BoolVar(&options.stats, "stats", false, "Print database statistics")
 	flag.BoolVar(&options.help, "help", false, "This help")
 
 	flag.BoolVar(&options.web, "web", false, "Enable web interface")
@@ -91,17 +159,57 @@ func parseConfig() (*Config, error) {
 		fmt.Println("Copyright:", "2024-2025 by Ubaldo Porcheddu <ubaldo@eja.it>")
 		fmt.Println("Version:", Version)
 		fmt.Printf("Usage: %s [options]\n", os.Args[0])
-		fmt.Println("Options:\n")
+		fmt.Print("Options:\n\n")
 		flag.PrintDefaults()
 		fmt.Println()
 	}
 
 	flag.Parse()
 
+	if paths := strings.Split(options.dbPath, ","); len(paths) > 1 {
+		options.dbPath = strings.TrimSpace(paths[0])
+		for _, path := range paths[1:] {
+			if path = strings.TrimSpace(path); path != "" {
+				options.dbFederated = append(options.dbFederated, path)
+			}
+		}
+	}
+
 	if options.aiThreads == 0 {
 		options.aiThreads = runtime.NumCPU()
 	}
 
+	if options.cacheEmbeddings < 0 || options.cacheSize < 0 || options.cacheTtl < 0 {
+		return nil, fmt.Errorf("invalid cache size or ttl")
+	}
+	if options.aiChunkTokens < 0 || options.aiChunkOverlap < 0 || (options.aiChunkTokens > 0 && options.aiChunkOverlap >= options.aiChunkTokens) {
+		return nil, fmt.Errorf("invalid chunk tokens or overlap: %d, %d", options.aiChunkTokens, options.aiChunkOverlap)
+	}
+	if options.dbWal && (options.web || options.cli) && (options.wikiImport != "" || options.aiModelImport != "" || options.dbCompress || options.dbMerge != "" || options.dbTokenizer != "" || options.dbTrigram != "") {
+		return nil, fmt.Errorf("only -ai-sync can run while serving with -db-wal")
+	}
+	if options.evalFormat != "table" && options.evalFormat != "json" {
+		return nil, fmt.Errorf("unsupported evaluation format: %q", options.evalFormat)
+	}
+	if _, err := EvalCutoffs(options.evalK); err != nil {
+		return nil, err
+	}
+	if options.limit < 1 {
+		return nil, fmt.Errorf("invalid limit: %d", options.limit)
+	}
+	if options.aiRerankTop < 1 {
+		return nil, fmt.Errorf("invalid rerank top: %d", options.aiRerankTop)
+	}
+	if options.searchPassage != "lexical" && options.searchPassage != "embedding" {
+		return nil, fmt.Errorf("unsupported search passage: %q", options.searchPassage)
+	}
+	if _, err := SearchWeightsParse(options.searchWeights, nil); err != nil {
+		return nil, err
+	}
+	if err := SearchSettingsDefault().Validate(); err != nil {
+		return nil, err
+	}
+
 	return options, nil
 }
 
@@ -150,43 +258,158 @@ func main() {
 		}
 	}()
 
+	if err := FederatedOpen(options.dbFederated); err != nil {
+		log.Fatalf("Error initializing federated databases: %v\n", err)
+	}
+	defer FederatedClose()
+
 	if err := aiInit(); err != nil {
 		log.Printf("AI initialization error: %v\n", err)
 	} else {
 		ai = true
 	}
 
-	if options.aiSync || options.wikiImport != "" || options.aiModelImport != "" || options.dbCompress {
-		if err := db.PragmaImportMode(); err != nil {
-			log.Fatalf("Error setting database in import mode: %v\n", err)
+	if err := CacheInit(); err != nil {
+		log.Printf("Cache initialization error: %v\n", err)
+	}
+	defer CacheClose()
+
+	if options.aiRerankModel != "" {
+		if err := aiRerankInit(options.aiRerankModel); err != nil {
+			log.Printf("AI reranker initialization error: %v\n", err)
 		}
+		defer aiRerankClose()
+	}
 
-		if options.aiModelImport != "" {
-			if err = db.AiModelImport(options.aiModelImport); err != nil {
-				log.Fatalf("Error importing model file into the database: %v\n", err)
+	process := func() error {
+		if options.aiSync || options.wikiImport != "" || options.aiModelImport != "" || options.dbCompress || options.dbMerge != "" || options.dbTokenizer != "" || options.dbTrigram != "" {
+			if err := db.PragmaImportMode(); err != nil {
+				return fmt.Errorf("error setting database in import mode: %v", err)
 			}
-		}
 
-		if options.wikiImport != "" {
-			if err = WikiImport(options.wikiImport); err != nil {
-				log.Fatalf("Error processing import: %v\n", err)
+			if options.aiModelImport != "" {
+				if err := db.AiModelImport(options.aiModelImport); err != nil {
+					return fmt.Errorf("error importing model file into the database: %v", err)
+				}
+			}
+
+			if options.wikiImport != "" {
+				if err := WikiImport(options.wikiImport); err != nil {
+					return fmt.Errorf("error processing import: %v", err)
+				}
+			}
+
+			if options.dbTokenizer != "" && options.wikiImport == "" {
+				if err := db.Retokenize(options.dbTokenizer); err != nil {
+					return fmt.Errorf("error changing the search tokenizer: %v", err)
+				}
+			}
+
+			if options.dbTrigram != "" && options.wikiImport == "" {
+				if err := db.ProcessTrigram(options.dbTrigram); err != nil {
+					return fmt.Errorf("error building the trigram index: %v", err)
+				}
+			}
+
+			if options.dbMerge != "" {
+				if err := db.Merge(options.dbMerge); err != nil {
+					return fmt.Errorf("error merging database: %v", err)
+				}
+			}
+
+			if ai && options.aiSync {
+				if err := db.ProcessEmbeddings(); err != nil {
+					return fmt.Errorf("error processing embeddings: %v", err)
+				}
+			}
+
+			if options.dbCompress {
+				if err := db.Compress(); err != nil {
+					return fmt.Errorf("error compressing the database: %v", err)
+				}
 			}
-		}
 
-		if ai && options.aiSync {
-			if err := db.ProcessEmbeddings(); err != nil {
-				log.Fatalf("Error processing embeddings: %v\n", err)
+			if err := db.PragmaReadMode(); err != nil {
+				return fmt.Errorf("error setting database in read mode: %v", err)
 			}
 		}
+		return nil
+	}
 
-		if options.dbCompress {
-			if err := db.Compress(); err != nil {
-				log.Fatalf("Error compressing the database: %v\n", err)
+	if ai && options.aiSync {
+		if err := db.ProcessChunking(); err != nil {
+			log.Fatalf("Error storing the embedding passages size: %v\n", err)
+		}
+	}
+
+	if options.dbWal && (options.web || options.cli) {
+		go func() {
+			if err := process(); err != nil {
+				log.Printf("Error processing the database: %v\n", err)
+			}
+		}()
+	} else if err := process(); err != nil {
+		log.Fatalf("Error processing the database: %v\n", err)
+	}
+
+	if options.stats {
+		handlers := federatedHandlers()
+		var stats []DBStats
+		for _, h := range handlers {
+			item, err := h.Stats(context.Background(), true)
+			if err != nil {
+				log.Fatalf("Error reading database statistics: %v\n", err)
 			}
+			if len(handlers) > 1 {
+				item.Source = h.name
+			}
+			stats = append(stats, item)
+		}
+		var data []byte
+		if len(stats) == 1 {
+			data, _ = json.MarshalIndent(stats[0], "", "  ")
+		} else {
+			data, _ = json.MarshalIndent(stats, "", "  ")
+		}
+		fmt.Println(string(data))
+	}
+
+	if options.publish != "" {
+		if err := db.ProcessTitleIndex(); err != nil {
+			log.Fatalf("Error indexing titles: %v\n", err)
 		}
+		if _, err := Publish(options.dbPath, options.publish, options.publishName, int64(options.publishSize)*1024*1024); err != nil {
+			log.Fatalf("Error publishing database: %v\n", err)
+		}
+	}
 
-		if err := db.PragmaReadMode(); err != nil {
-			log.Fatalf("Error setting database in read mode: %v\n", err)
+	if options.eval != "" {
+		cutoffs, _ := EvalCutoffs(options.evalK)
+		if err := Evaluate(context.Background(), options.eval, cutoffs, options.evalAnn, options.evalFormat, os.Stdout); err != nil {
+			log.Fatalf("Error evaluating searches: %v\n", err)
+		}
+	}
+
+	if options.export != "" {
+		format, err := ExportFormat(options.exportFormat, options.export)
+		if err != nil {
+			log.Fatalf("Error exporting articles: %v\n", err)
+		}
+		var refs []string
+		for _, value := range strings.Split(options.exportIDs, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				if _, _, err := ArticleRefParse(value); err != nil {
+					log.Fatalf("Invalid export article ID: %s\n", value)
+				}
+				refs = append(refs, value)
+			}
+		}
+		articles, err := ExportArticles(context.Background(), refs, strings.Split(options.exportTitles, "|"), options.exportQuery, options.limit)
+		if err != nil {
+			log.Fatalf("Error exporting articles: %v\n", err)
+		}
+		if err := ExportFile(options.export, format, articles); err != nil {
+			log.Fatalf("Error exporting articles: %v\n", err)
 		}
 	}
 
@@ -3,11 +3,13 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -113,7 +115,7 @@ func (s *WebServer) handleMCP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Mcp-Session-Id", sessionID)
 			w.Header().Set("Content-Type", "application/json")
 
-			resp := handleJSONRPC(req)
+			resp := handleJSONRPC(r.Context(), req)
 			_ = json.NewEncoder(w).Encode(resp)
 			return
 		}
@@ -127,7 +129,7 @@ func (s *WebServer) handleMCP(w http.ResponseWriter, r *http.Request) {
 			sess = registerSession(sessionID)
 		}
 
-		resp := handleJSONRPC(req)
+		resp := handleJSONRPC(r.Context(), req)
 		if resp.JSONRPC != "" {
 			w.Header().Set("Content-Type", "application/json")
 			_ = json.NewEncoder(w).Encode(resp)
@@ -197,7 +199,7 @@ func (s *WebServer) handleMCP(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-func handleJSONRPC(req jsonRPCRequest) jsonRPCResponse {
+func handleJSONRPC(ctx context.Context, req jsonRPCRequest) jsonRPCResponse {
 	resp := jsonRPCResponse{
 		JSONRPC: "2.0",
 		ID:      req.ID,
@@ -255,6 +257,19 @@ func handleJSONRPC(req jsonRPCRequest) jsonRPCResponse {
 								"type":        "integer",
 								"description": "Optional maximum number of search results to return.",
 								"default":     25,
+								"maximum":     max(SearchMaxLimit, options.limit),
+							},
+							"offset": map[string]any{
+								"type":        "integer",
+								"description": "Optional number of results to skip, to read the following pages of a search.",
+								"default":     0,
+								"maximum":     SearchMaxOffset,
+							},
+							"group": map[string]any{
+								"type":        "string",
+								"enum":        []string{"article", "section"},
+								"description": "Optional grouping of the results: one per article, or one per matching section.",
+								"default":     "article",
 							},
 						},
 						"required": []string{"query"},
@@ -262,16 +277,63 @@ func handleJSONRPC(req jsonRPCRequest) jsonRPCResponse {
 				},
 				{
 					"name":        "article",
-					"description": "Retrieve the full text and all sections of a Wikipedia article by its integer ID.",
+					"description": "Retrieve the full text and all sections of a Wikipedia article by its ID, exact title or Wikidata entity.",
 					"inputSchema": map[string]any{
 						"type": "object",
 						"properties": map[string]any{
 							"id": map[string]any{
+								"type":        []string{"integer", "string"},
+								"description": "The article ID as returned by search, either an integer or a source:id reference when several databases are served.",
+							},
+							"title": map[string]any{
+								"type":        "string",
+								"description": "The article title, matched ignoring case and diacritics.",
+							},
+							"entity": map[string]any{
+								"type":        "string",
+								"description": "The Wikidata entity identifier of the article, for example Q42.",
+							},
+						},
+					},
+				},
+				{
+					"name":        "related",
+					"description": "List the articles most similar to a Wikipedia article, found by comparing the embeddings of their sections.",
+					"inputSchema": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"id": map[string]any{
+								"type":        []string{"integer", "string"},
+								"description": "The article ID as returned by search, either an integer or a source:id reference when several databases are served.",
+							},
+							"title": map[string]any{
+								"type":        "string",
+								"description": "The article title, matched ignoring case and diacritics.",
+							},
+							"entity": map[string]any{
+								"type":        "string",
+								"description": "The Wikidata entity identifier of the article, for example Q42.",
+							},
+							"limit": map[string]any{
 								"type":        "integer",
-								"description": "The unique integer ID of the article to retrieve.",
+								"description": "Optional maximum number of related articles to return.",
+								"default":     25,
+								"maximum":     max(SearchMaxLimit, options.limit),
+							},
+						},
+					},
+				},
+				{
+					"name":        "stats",
+					"description": "Report the content of the Wikilite database: article, section and vector counts, compression, ANN index, embedded model and setup.",
+					"inputSchema": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"tables": map[string]any{
+								"type":        "boolean",
+								"description": "Optional, also report the size of every table, which reads the whole database.",
 							},
 						},
-						"required": []string{"id"},
 					},
 				},
 			},
@@ -290,7 +352,7 @@ func handleJSONRPC(req jsonRPCRequest) jsonRPCResponse {
 			return resp
 		}
 
-		resp.Result = handleToolCall(params.Name, params.Arguments)
+		resp.Result = handleToolCall(ctx, params.Name, params.Arguments)
 
 	default:
 		resp.Error = jsonRPCError{
@@ -302,7 +364,10 @@ func handleJSONRPC(req jsonRPCRequest) jsonRPCResponse {
 	return resp
 }
 
-func handleToolCall(name string, args map[string]any) map[string]any {
+func handleToolCall(ctx context.Context, name string, args map[string]any) map[string]any {
+	ctx, cancel := SearchContext(ctx, 0)
+	defer cancel()
+
 	switch name {
 	case "search":
 		query, _ := args["query"].(string)
@@ -327,7 +392,34 @@ func handleToolCall(name string, args map[string]any) map[string]any {
 			}
 		}
 
-		results, err := Search(query, limit)
+		offset := 0
+		if offsetVal, ok := args["offset"]; ok {
+			if f, ok := offsetVal.(float64); ok {
+				offset = int(f)
+			} else if i, ok := offsetVal.(int); ok {
+				offset = i
+			}
+		}
+		limit = max(limit, 1)
+		offset = max(offset, 0)
+
+		settings := SearchSettingsDefault()
+		if group, _ := args["group"].(string); group != "" {
+			settings.Group = group
+			if err := settings.Validate(); err != nil {
+				return map[string]any{
+					"content": []map[string]any{
+						{
+							"type": "text",
+							"text": fmt.Sprintf("Error: %v", err),
+						},
+					},
+					"isError": true,
+				}
+			}
+		}
+
+		results, suggestion, hasMore, err := SearchPage(ctx, SearchCached("search", SearchSuggest), query, settings, offset, limit)
 		if err != nil {
 			return map[string]any{
 				"content": []map[string]any{
@@ -342,11 +434,17 @@ func handleToolCall(name string, args map[string]any) map[string]any {
 
 		var sb strings.Builder
 		sb.WriteString(fmt.Sprintf("Search results for '%s' (limit %d):\n\n", query, limit))
+		if suggestion != "" {
+			sb.WriteString(fmt.Sprintf("Did you mean '%s'? Showing results for it.\n\n", suggestion))
+		}
 		if len(results) == 0 {
 			sb.WriteString("No articles found matching the query.")
 		} else {
 			for i, r := range results {
-				sb.WriteString(fmt.Sprintf("%d. **%s** (Article ID: %d)\n", i+1, r.Title, r.ArticleID))
+				sb.WriteString(fmt.Sprintf("%d. **%s** (Article ID: %s)\n", offset+i+1, r.Title, r.Ref()))
+				if r.SectionTitle != "" {
+					sb.WriteString(fmt.Sprintf("   Section: %s (Section ID: %d)\n", r.SectionTitle, r.SectionID))
+				}
 				sb.WriteString(fmt.Sprintf("   Match Score: %.2f%%\n", r.Power))
 				if r.Snippet != "" {
 					sb.WriteString(fmt.Sprintf("   Snippet: %s\n", r.Snippet))
@@ -355,6 +453,10 @@ func handleToolCall(name string, args map[string]any) map[string]any {
 			}
 		}
 
+		if hasMore {
+			sb.WriteString(fmt.Sprintf("More results are available with offset %d.\n", offset+len(results)))
+		}
+
 		return map[string]any{
 			"content": []map[string]any{
 				{
@@ -366,43 +468,84 @@ func handleToolCall(name string, args map[string]any) map[string]any {
 		}
 
 	case "article":
-		idVal, ok := args["id"]
-		if !ok {
+		id, errResult := mcpArticleRef(ctx, args)
+		if errResult != nil {
+			return errResult
+		}
+
+		article, err := ArticleGet(ctx, id)
+		if err != nil {
 			return map[string]any{
 				"content": []map[string]any{
 					{
 						"type": "text",
-						"text": "Error: id parameter is missing.",
+						"text": fmt.Sprintf("Error retrieving article ID %s: %v", id, err),
 					},
 				},
 				"isError": true,
 			}
 		}
 
-		var id int
-		if f, ok := idVal.(float64); ok {
-			id = int(f)
-		} else if i, ok := idVal.(int); ok {
-			id = i
-		} else {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("# %s\n", article.Title))
+		if article.Entity != "" {
+			sb.WriteString(fmt.Sprintf("Entity Identifier: %s\n", article.Entity))
+		}
+		sb.WriteString("\n")
+
+		for _, sec := range article.Sections {
+			if sec.Title != "" {
+				sb.WriteString(fmt.Sprintf("## %s\n", sec.Title))
+			}
+			sb.WriteString(sec.Content)
+			sb.WriteString("\n\n")
+		}
+
+		return map[string]any{
+			"content": []map[string]any{
+				{
+					"type": "text",
+					"text": sb.String(),
+				},
+			},
+			"isError": false,
+		}
+
+	case "related":
+		id, errResult := mcpArticleRef(ctx, args)
+		if errResult != nil {
+			return errResult
+		}
+
+		limit := options.limit
+		if limitVal, ok := args["limit"]; ok {
+			if f, ok := limitVal.(float64); ok {
+				limit = int(f)
+			} else if i, ok := limitVal.(int); ok {
+				limit = i
+			}
+		}
+		limit = max(limit, 1)
+
+		if err := SearchPageCheck(0, limit); err != nil {
 			return map[string]any{
 				"content": []map[string]any{
 					{
 						"type": "text",
-						"text": "Error: id must be an integer.",
+						"text": fmt.Sprintf("Error: %v", err),
 					},
 				},
 				"isError": true,
 			}
 		}
 
-		article, err := db.ArticleGet(id)
+		results, err := SearchRelated(ctx, id, limit, "")
 		if err != nil {
 			return map[string]any{
 				"content": []map[string]any{
 					{
 						"type": "text",
-						"text": fmt.Sprintf("Error retrieving article ID %d: %v", id, err),
+						"text": fmt.Sprintf("Error retrieving related articles for ID %s: %v", id, err),
 					},
 				},
 				"isError": true,
@@ -410,25 +553,55 @@ func handleToolCall(name string, args map[string]any) map[string]any {
 		}
 
 		var sb strings.Builder
-		sb.WriteString(fmt.Sprintf("# %s\n", article.Title))
-		if article.Entity != "" {
-			sb.WriteString(fmt.Sprintf("Entity Identifier: %s\n", article.Entity))
+		sb.WriteString(fmt.Sprintf("Articles related to ID %s (limit %d):\n\n", id, limit))
+		if len(results) == 0 {
+			sb.WriteString("No related articles found, the article may have no embeddings.")
+		} else {
+			for i, r := range results {
+				sb.WriteString(fmt.Sprintf("%d. **%s** (Article ID: %s)\n", i+1, r.Title, r.Ref()))
+				if r.SectionTitle != "" {
+					sb.WriteString(fmt.Sprintf("   Closest Section: %s (Section ID: %d)\n", r.SectionTitle, r.SectionID))
+				}
+				sb.WriteString(fmt.Sprintf("   Similarity: %.2f%%\n\n", r.Power))
+			}
 		}
-		sb.WriteString("\n")
 
-		for _, sec := range article.Sections {
-			if sec.Title != "" {
-				sb.WriteString(fmt.Sprintf("## %s\n", sec.Title))
+		return map[string]any{
+			"content": []map[string]any{
+				{
+					"type": "text",
+					"text": sb.String(),
+				},
+			},
+			"isError": false,
+		}
+
+	case "stats":
+		tables, _ := args["tables"].(bool)
+		stats, err := FederatedStats(ctx, tables)
+		if err != nil {
+			return map[string]any{
+				"content": []map[string]any{
+					{
+						"type": "text",
+						"text": fmt.Sprintf("Error retrieving stats: %v", err),
+					},
+				},
+				"isError": true,
 			}
-			sb.WriteString(sec.Content)
-			sb.WriteString("\n\n")
 		}
 
+		var data []byte
+		if len(stats) == 1 {
+			data, _ = json.MarshalIndent(stats[0], "", "  ")
+		} else {
+			data, _ = json.MarshalIndent(stats, "", "  ")
+		}
 		return map[string]any{
 			"content": []map[string]any{
 				{
 					"type": "text",
-					"text": sb.String(),
+					"text": string(data),
 				},
 			},
 			"isError": false,
@@ -446,3 +619,58 @@ func handleToolCall(name string, args map[string]any) map[string]any {
 		}
 	}
 }
+
+// mcpArticleRef returns the reference of the article given by the id,
+// title or entity argument, or the error result of the tool call.
+func mcpArticleRef(ctx context.Context, args map[string]any) (string, map[string]any) {
+	idVal, ok := args["id"]
+	title, _ := args["title"].(string)
+	entity, _ := args["entity"].(string)
+	if !ok && title == "" && entity == "" {
+		return "", map[string]any{
+			"content": []map[string]any{
+				{
+					"type": "text",
+					"text": "Error: one of id, title or entity is required.",
+				},
+			},
+			"isError": true,
+		}
+	}
+
+	var id string
+	if f, ok := idVal.(float64); ok {
+		id = strconv.Itoa(int(f))
+	} else if i, ok := idVal.(int); ok {
+		id = strconv.Itoa(i)
+	} else if s, ok := idVal.(string); ok {
+		id = s
+	}
+	if !ok {
+		ref, err := ArticleFind(ctx, title, entity)
+		if err != nil {
+			return "", map[string]any{
+				"content": []map[string]any{
+					{
+						"type": "text",
+						"text": fmt.Sprintf("Error: no article found for %s.", strings.TrimSpace(title+" "+entity)),
+					},
+				},
+				"isError": true,
+			}
+		}
+		id = ref
+	}
+	if _, _, err := ArticleRefParse(id); err != nil {
+		return "", map[string]any{
+			"content": []map[string]any{
+				{
+					"type": "text",
+					"text": "Error: id must be an integer or a source:id reference.",
+				},
+			},
+			"isError": true,
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,301 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	SearchPassageRunes     = 160
+	SearchPassageMaxRunes  = 320
+	SearchPassageResults   = 5
+	SearchPassageSentences = 32
+)
+
+// SearchPassages replaces the snippet of the semantic results with the
+// sentence window that best matches the query, with the query words marked,
+// and stores the window offsets inside the section text as highlight. The
+// sentences are scored by lexical overlap or, with -search-passage embedding,
+// by similarity with the query embedding for the best results. When the
+// section was embedded by passages, only the sentences of its best passage
+// are candidates.
+func SearchPassages(ctx context.Context, query string, queryEmbedding []float32, results []SearchResult) error {
+	start := time.Now()
+	terms := passageTerms(query)
+
+	order := make([]int, len(results))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return results[order[i]].Power > results[order[j]].Power
+	})
+
+	for rank, i := range order {
+		text := results[i].Text
+		sentences := passageSentences(text)
+		if len(results[i].Highlights) == 1 {
+			var within [][2]int
+			for _, sentence := range sentences {
+				if sentence[1] > results[i].Highlights[0][0] && sentence[0] < results[i].Highlights[0][1] {
+					within = append(within, sentence)
+				}
+			}
+			if len(within) > 0 {
+				sentences = within
+			}
+		}
+		if len(sentences) == 0 {
+			continue
+		}
+
+		var scores []float64
+		if options.searchPassage == "embedding" && rank < SearchPassageResults && len(sentences) > 1 && queryEmbedding != nil {
+			var err error
+			scores, err = passageEmbeddingScores(ctx, text, sentences, queryEmbedding)
+			if err != nil {
+				return err
+			}
+		} else {
+			scores = passageLexicalScores(text, sentences, terms)
+		}
+
+		best := 0
+		for j := range scores {
+			if scores[j] > scores[best] {
+				best = j
+			}
+		}
+
+		passageStart, passageEnd := passageWindow(text, sentences, best)
+		results[i].Snippet = passageSnippet(text, passageStart, passageEnd, terms)
+		results[i].Highlights = [][2]int{{passageStart, passageEnd}}
+	}
+
+	if options.log {
+		log.Printf("Search passages: %d results (%v)", len(results), time.Since(start))
+	}
+	return nil
+}
+
+// passageSentences returns the byte offsets of the sentences of text, split
+// at the end of line or after a full stop followed by a space.
+func passageSentences(text string) [][2]int {
+	var sentences [][2]int
+	start, end := -1, 0
+	terminal := false
+	flush := func() {
+		if start >= 0 {
+			sentences = append(sentences, [2]int{start, end})
+		}
+		start = -1
+		terminal = false
+	}
+
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if terminal || r == '\n' {
+				flush()
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		end = i + utf8.RuneLen(r)
+		terminal = strings.ContainsRune(".!?", r)
+		if strings.ContainsRune("。！？", r) {
+			flush()
+		}
+	}
+	flush()
+
+	return sentences
+}
+
+// passageWords returns the byte offsets of the words of text.
+func passageWords(text string) [][2]int {
+	var words [][2]int
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			words = append(words, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, [2]int{start, len(text)})
+	}
+	return words
+}
+
+func passageTerms(query string) []string {
+	text := QueryText(query)
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range passageWords(text) {
+		term := TextNormalize(text[word[0]:word[1]])
+		if utf8.RuneCountInString(term) < 2 || seen[term] {
+			continue
+		}
+		seen[term] = true
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// passageMatch returns the term matching a normalized word, either equal or
+// sharing a prefix of at least four runes with it.
+func passageMatch(word string, terms []string) (string, bool) {
+	for _, term := range terms {
+		if word == term {
+			return term, true
+		}
+		short, long := term, word
+		if len(short) > len(long) {
+			short, long = long, short
+		}
+		if utf8.RuneCountInString(short) >= 4 && strings.HasPrefix(long, short) {
+			return term, true
+		}
+	}
+	return "", false
+}
+
+// passageLexicalScores sums, for every sentence, the inverse sentence
+// frequency of the query terms it contains.
+func passageLexicalScores(text string, sentences [][2]int, terms []string) []float64 {
+	matches := make([]map[string]bool, len(sentences))
+	frequency := make(map[string]int)
+	for i, sentence := range sentences {
+		matches[i] = make(map[string]bool)
+		value := text[sentence[0]:sentence[1]]
+		for _, word := range passageWords(value) {
+			if term, ok := passageMatch(TextNormalize(value[word[0]:word[1]]), terms); ok {
+				matches[i][term] = true
+			}
+		}
+		for term := range matches[i] {
+			frequency[term]++
+		}
+	}
+
+	scores := make([]float64, len(sentences))
+	for i := range sentences {
+		for term := range matches[i] {
+			scores[i] += math.Log(1 + float64(len(sentences))/float64(frequency[term]))
+		}
+	}
+	return scores
+}
+
+// passageEmbeddingScores returns the cosine similarity between the query and
+// the first SearchPassageSentences sentences, the others are never chosen.
+func passageEmbeddingScores(ctx context.Context, text string, sentences [][2]int, queryEmbedding []float32) ([]float64, error) {
+	count := min(len(sentences), SearchPassageSentences)
+	inputs := make([]string, count)
+	for i := range inputs {
+		inputs[i] = options.aiModelPrefixSave + text[sentences[i][0]:sentences[i][1]]
+	}
+
+	var embeddings [][]float32
+	if options.aiApi {
+		var err error
+		embeddings, err = aiApiEmbeddingsBatch(ctx, inputs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		embeddings = make([][]float32, count)
+		for i, input := range inputs {
+			embedding, err := localAiEmbeddings(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			embeddings[i] = embedding
+		}
+	}
+	if len(embeddings) != count {
+		return nil, fmt.Errorf("error embedding passages: %d embeddings for %d sentences", len(embeddings), count)
+	}
+
+	scores := make([]float64, len(sentences))
+	for i := range scores {
+		scores[i] = math.Inf(-1)
+		if i < count && len(embeddings[i]) == len(queryEmbedding) {
+			norm := math.Sqrt(float64(dot(embeddings[i], embeddings[i])) * float64(dot(queryEmbedding, queryEmbedding)))
+			if norm > 0 {
+				scores[i] = float64(dot(embeddings[i], queryEmbedding)) / norm
+			}
+		}
+	}
+	return scores, nil
+}
+
+// passageWindow grows the best sentence with the following, or previous,
+// sentences up to SearchPassageRunes, never beyond SearchPassageMaxRunes.
+func passageWindow(text string, sentences [][2]int, best int) (int, int) {
+	runes := func(first, last int) int {
+		return utf8.RuneCountInString(text[sentences[first][0]:sentences[last][1]])
+	}
+
+	first, last := best, best
+	for runes(first, last) < SearchPassageRunes {
+		if last+1 < len(sentences) && runes(first, last+1) <= SearchPassageMaxRunes {
+			last++
+		} else if first > 0 && runes(first-1, last) <= SearchPassageMaxRunes {
+			first--
+		} else {
+			break
+		}
+	}
+
+	start, end := sentences[first][0], sentences[last][1]
+	if value := []rune(text[start:end]); len(value) > SearchPassageMaxRunes {
+		end = start + len(string(value[:SearchPassageMaxRunes]))
+	}
+	return start, end
+}
+
+// passageSnippet returns the HTML of the text from start to end, escaped
+// and with the words matching terms inside <mark> tags.
+func passageSnippet(text string, start, end int, terms []string) string {
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("...")
+	}
+
+	window := text[start:end]
+	last := 0
+	for _, word := range passageWords(window) {
+		if _, ok := passageMatch(TextNormalize(window[word[0]:word[1]]), terms); ok {
+			sb.WriteString(html.EscapeString(window[last:word[0]]))
+			sb.WriteString("<mark>")
+			sb.WriteString(html.EscapeString(window[word[0]:word[1]]))
+			sb.WriteString("</mark>")
+			last = word[1]
+		}
+	}
+	sb.WriteString(html.EscapeString(window[last:]))
+
+	if end < len(text) {
+		sb.WriteString("...")
+	}
+	return sb.String()
+}
@@ -0,0 +1,25 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import "testing"
+
+func TestPassageSnippet(t *testing.T) {
+	tests := []struct {
+		text       string
+		start, end int
+		query      string
+		want       string
+	}{
+		{"The climate is mild.", 0, 20, "climate", "The <mark>climate</mark> is mild."},
+		{"Rome. The climate is mild. More", 6, 26, "climate", "...The <mark>climate</mark> is mild...."},
+		{"if a < b && c > d then <b>climate</b>", 0, 37, "climate", "if a &lt; b &amp;&amp; c &gt; d then &lt;b&gt;<mark>climate</mark>&lt;/b&gt;"},
+		{`Caffè "latte"`, 0, 14, "caffe", `<mark>Caffè</mark> &#34;latte&#34;`},
+	}
+
+	for _, test := range tests {
+		if got := passageSnippet(test.text, test.start, test.end, passageTerms(test.query)); got != test.want {
+			t.Errorf("passageSnippet(%q, %d, %d, %q) = %q, want %q", test.text, test.start, test.end, test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const PublishBlockSize = 1024 * 1024
+
+type PublishPart struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type PublishManifest struct {
+	Name     string        `json:"name"`
+	Version  string        `json:"version,omitempty"`
+	Language string        `json:"language,omitempty"`
+	Model    string        `json:"model,omitempty"`
+	AnnSize  string        `json:"annSize,omitempty"`
+	Size     int64         `json:"size"`
+	SHA256   string        `json:"sha256"`
+	Created  string        `json:"created"`
+	Parts    []PublishPart `json:"parts"`
+}
+
+type publishPartWriter struct {
+	file    *os.File
+	gz      *gzip.Writer
+	hash    hash.Hash
+	size    int64
+	pending int64
+}
+
+func (pw *publishPartWriter) Write(p []byte) (int, error) {
+	n, err := pw.file.Write(p)
+	pw.hash.Write(p[:n])
+	pw.size += int64(n)
+	return n, err
+}
+
+func Publish(dbPath string, outputDir string, name string, partSize int64) (*PublishManifest, error) {
+	start := time.Now()
+
+	if partSize < 2*PublishBlockSize {
+		partSize = 2 * PublishBlockSize
+	}
+
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(dbPath), filepath.Ext(dbPath))
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating output directory: %v", err)
+	}
+
+	wal, err := publishIsWAL(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if wal {
+		snapshot := filepath.Join(outputDir, name+".db.tmp")
+		if err := publishSnapshot(dbPath, snapshot); err != nil {
+			return nil, err
+		}
+		defer os.Remove(snapshot)
+		dbPath = snapshot
+	}
+
+	input, err := os.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading database size: %v", err)
+	}
+
+	manifest := &PublishManifest{
+		Name:    name,
+		Size:    info.Size(),
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+	manifest.Version, _ = db.SetupGet("version")
+	manifest.Language, _ = db.SetupGet("language")
+	manifest.Model, _ = db.SetupGet("model")
+	manifest.AnnSize, _ = db.SetupGet("annSize")
+
+	dbHash := sha256.New()
+	reader := io.TeeReader(input, dbHash)
+	buf := make([]byte, PublishBlockSize)
+
+	var part *publishPartWriter
+	closePart := func() error {
+		if part == nil {
+			return nil
+		}
+		if err := part.gz.Close(); err != nil {
+			part.file.Close()
+			return fmt.Errorf("error compressing part: %v", err)
+		}
+		if err := part.file.Close(); err != nil {
+			return fmt.Errorf("error closing part: %v", err)
+		}
+		manifest.Parts = append(manifest.Parts, PublishPart{
+			File:   filepath.Base(part.file.Name()),
+			Size:   part.size,
+			SHA256: hex.EncodeToString(part.hash.Sum(nil)),
+		})
+		log.Printf("Publish part: %s (%d bytes)", filepath.Base(part.file.Name()), part.size)
+		part = nil
+		return nil
+	}
+
+	var processed int64
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if n > 0 {
+			// part.size only counts what the compressor has written so far,
+			// so flush it before the pending bytes could overflow the part.
+			if part != nil && part.size+publishBound(part.pending+int64(n)) > partSize {
+				if err := part.gz.Flush(); err != nil {
+					return nil, fmt.Errorf("error compressing part: %v", err)
+				}
+				part.pending = 0
+				if part.size+publishBound(int64(n)) > partSize {
+					if err := closePart(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if part == nil {
+				file, err := os.Create(filepath.Join(outputDir, fmt.Sprintf("%s.db-%03d.gz", name, len(manifest.Parts)+1)))
+				if err != nil {
+					return nil, fmt.Errorf("error creating part: %v", err)
+				}
+				part = &publishPartWriter{file: file, hash: sha256.New()}
+				part.gz, _ = gzip.NewWriterLevel(part, gzip.BestCompression)
+			}
+			if _, err := part.gz.Write(buf[:n]); err != nil {
+				return nil, fmt.Errorf("error compressing part: %v", err)
+			}
+			part.pending += int64(n)
+			processed += int64(n)
+			if processed%(100*PublishBlockSize) == 0 {
+				log.Printf("Publish progress: %.2f%%", float64(processed)/float64(manifest.Size)*100)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("error reading database: %v", readErr)
+		}
+	}
+	if err := closePart(); err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Parts) == 1 {
+		single := name + ".db.gz"
+		if err := os.Rename(filepath.Join(outputDir, manifest.Parts[0].File), filepath.Join(outputDir, single)); err != nil {
+			return nil, fmt.Errorf("error renaming part: %v", err)
+		}
+		manifest.Parts[0].File = single
+	}
+
+	manifest.SHA256 = hex.EncodeToString(dbHash.Sum(nil))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, name+".json"), append(data, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %v", err)
+	}
+
+	log.Printf("Publish completed: %d parts in %v", len(manifest.Parts), time.Since(start))
+	return manifest, nil
+}
+
+// publishBound returns the largest gzip output of n bytes, stored blocks of
+// at most 64KB with a 5 bytes header each, plus the gzip header and trailer.
+func publishBound(n int64) int64 {
+	return n + (n/65535+1)*5 + 1024
+}
+
+// publishIsWAL reports whether the database file is in WAL mode, where
+// the latest changes can still be in the -wal file.
+func publishIsWAL(dbPath string) (bool, error) {
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false, fmt.Errorf("error reading database header: %v", err)
+	}
+	return header[18] == 2 || header[19] == 2, nil
+}
+
+// publishSnapshot copies a WAL database, with the changes not checkpointed
+// yet, into a single file in rollback journal mode.
+func publishSnapshot(dbPath string, snapshot string) error {
+	log.Printf("Publish: copying the WAL database into %s", snapshot)
+	os.Remove(snapshot)
+
+	conn, err := sqlite.OpenConn(dbPath, sqlite.OpenReadOnly)
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer conn.Close()
+
+	if err := sqlitex.ExecuteTransient(conn, "VACUUM INTO ?", &sqlitex.ExecOptions{
+		Args: []any{snapshot},
+	}); err != nil {
+		os.Remove(snapshot)
+		return fmt.Errorf("error copying database: %v", err)
+	}
+	return nil
+}
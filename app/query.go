@@ -0,0 +1,564 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	QueryMaxDepth     = 16
+	QueryNearDistance = 10
+)
+
+// QueryFields maps the query field prefixes to the title, section title or text.
+var QueryFields = map[string]string{
+	"title":   "article title",
+	"section": "section title",
+	"article": "article text",
+}
+
+type QuerySyntaxError struct {
+	msg string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return "invalid query: " + e.msg
+}
+
+func IsQuerySyntaxError(err error) bool {
+	var syntaxErr *QuerySyntaxError
+	return errors.As(err, &syntaxErr)
+}
+
+func querySyntaxError(format string, args ...any) error {
+	return &QuerySyntaxError{msg: fmt.Sprintf(format, args...)}
+}
+
+const (
+	queryTerm = iota
+	queryAnd
+	queryOr
+	queryNear
+)
+
+type queryNode struct {
+	kind     int
+	field    string
+	text     string
+	negated  bool
+	distance int
+	children []*queryNode
+}
+
+const (
+	queryTokenWord = iota
+	queryTokenPhrase
+	queryTokenMinus
+	queryTokenField
+	queryTokenOr
+	queryTokenNear
+	queryTokenOpen
+	queryTokenClose
+	queryTokenComma
+)
+
+type queryToken struct {
+	kind int
+	text string
+}
+
+func queryLex(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(query)
+	delimiter := func(r rune) bool {
+		return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' || r == ','
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: queryTokenOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: queryTokenClose})
+			i++
+		case r == ',':
+			tokens = append(tokens, queryToken{kind: queryTokenComma})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, querySyntaxError("missing closing quote")
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenPhrase, text: string(runes[i+1 : end])})
+			i = end + 1
+		case r == '-':
+			if i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && runes[i+1] != ')' && runes[i+1] != ',' {
+				tokens = append(tokens, queryToken{kind: queryTokenMinus})
+			}
+			i++
+		default:
+			end := i
+			for end < len(runes) && !delimiter(runes[end]) {
+				end++
+			}
+			word := string(runes[i:end])
+			i = end
+
+			if name, rest, found := strings.Cut(word, ":"); found {
+				if _, ok := QueryFields[strings.ToLower(name)]; ok {
+					tokens = append(tokens, queryToken{kind: queryTokenField, text: strings.ToLower(name)})
+					word = rest
+					if word == "" {
+						continue
+					}
+				}
+			}
+
+			switch {
+			case word == "OR":
+				tokens = append(tokens, queryToken{kind: queryTokenOr})
+			case word == "NEAR" && i < len(runes) && runes[i] == '(':
+				tokens = append(tokens, queryToken{kind: queryTokenNear})
+			default:
+				tokens = append(tokens, queryToken{kind: queryTokenWord, text: word})
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	depth  int
+}
+
+// QueryParse parses words, phrases, exclusions, OR, groups, NEAR and field prefixes.
+func QueryParse(query string) (*queryNode, error) {
+	tokens, err := queryLex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		switch p.tokens[p.pos].kind {
+		case queryTokenClose:
+			return nil, querySyntaxError("unexpected closing parenthesis")
+		case queryTokenComma:
+			return nil, querySyntaxError("unexpected comma outside NEAR")
+		}
+		return nil, querySyntaxError("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return node, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return queryToken{}, false
+}
+
+func (p *queryParser) parseOr() (*queryNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > QueryMaxDepth {
+		return nil, querySyntaxError("too many nested groups")
+	}
+
+	var alternatives []*queryNode
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		token, ok := p.peek()
+		if !ok || token.kind != queryTokenOr {
+			if node == nil && len(alternatives) > 0 {
+				return nil, querySyntaxError("OR without a term after it")
+			}
+			if node != nil {
+				alternatives = append(alternatives, node)
+			}
+			break
+		}
+		if node == nil {
+			return nil, querySyntaxError("OR without a term before it")
+		}
+		alternatives = append(alternatives, node)
+		p.pos++
+	}
+
+	switch len(alternatives) {
+	case 0:
+		return nil, nil
+	case 1:
+		return alternatives[0], nil
+	}
+	for _, node := range alternatives {
+		if node.negated {
+			return nil, querySyntaxError("OR alternatives cannot be only excluded terms")
+		}
+	}
+	return &queryNode{kind: queryOr, children: alternatives}, nil
+}
+
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	var terms []*queryNode
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind == queryTokenOr || token.kind == queryTokenClose || token.kind == queryTokenComma {
+			break
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			terms = append(terms, node)
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	included := false
+	for _, node := range terms {
+		included = included || !node.negated
+	}
+	if !included {
+		return nil, querySyntaxError("at least one term must not be excluded")
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return &queryNode{kind: queryAnd, children: terms}, nil
+}
+
+func (p *queryParser) parseUnary() (*queryNode, error) {
+	negated := false
+	field := ""
+	for {
+		token, ok := p.peek()
+		if !ok {
+			return nil, querySyntaxError("missing term at the end of the query")
+		}
+		if token.kind == queryTokenMinus && !negated && field == "" {
+			negated = true
+		} else if token.kind == queryTokenField && field == "" {
+			field = token.text
+		} else {
+			break
+		}
+		p.pos++
+	}
+
+	token, _ := p.peek()
+	var node *queryNode
+	switch token.kind {
+	case queryTokenWord, queryTokenPhrase:
+		p.pos++
+		if strings.TrimSpace(token.text) == "" {
+			return nil, nil
+		}
+		node = &queryNode{kind: queryTerm, text: token.text}
+	case queryTokenOpen:
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if token, ok := p.peek(); !ok || token.kind != queryTokenClose {
+			return nil, querySyntaxError("missing closing parenthesis")
+		}
+		p.pos++
+		if inner == nil {
+			return nil, querySyntaxError("empty parentheses")
+		}
+		node = inner
+	case queryTokenNear:
+		var err error
+		if node, err = p.parseNear(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, querySyntaxError("missing term after - or field prefix")
+	}
+
+	if field != "" {
+		node.setField(field)
+	}
+	if negated {
+		if node.negated {
+			return nil, querySyntaxError("term excluded twice")
+		}
+		node.negated = true
+	}
+	return node, nil
+}
+
+func (p *queryParser) parseNear() (*queryNode, error) {
+	p.pos += 2
+	node := &queryNode{kind: queryNear, distance: QueryNearDistance}
+terms:
+	for {
+		token, ok := p.peek()
+		if !ok {
+			return nil, querySyntaxError("missing closing parenthesis after NEAR")
+		}
+		p.pos++
+		switch token.kind {
+		case queryTokenWord, queryTokenPhrase:
+			if strings.TrimSpace(token.text) != "" {
+				node.children = append(node.children, &queryNode{kind: queryTerm, text: token.text})
+			}
+		case queryTokenComma:
+			distance, ok := p.peek()
+			if !ok || distance.kind != queryTokenWord {
+				return nil, querySyntaxError("missing NEAR distance")
+			}
+			n, err := strconv.Atoi(distance.text)
+			if err != nil || n < 0 {
+				return nil, querySyntaxError("invalid NEAR distance: %q", distance.text)
+			}
+			node.distance = n
+			p.pos++
+			if token, ok := p.peek(); !ok || token.kind != queryTokenClose {
+				return nil, querySyntaxError("missing closing parenthesis after NEAR distance")
+			}
+			p.pos++
+			break terms
+		case queryTokenClose:
+			break terms
+		default:
+			return nil, querySyntaxError("NEAR accepts only words and phrases")
+		}
+	}
+
+	if len(node.children) < 2 {
+		return nil, querySyntaxError("NEAR needs at least two terms")
+	}
+	return node, nil
+}
+
+// setField applies a field prefix to the terms of a group that have none.
+func (n *queryNode) setField(field string) {
+	if n.field != "" {
+		return
+	}
+	n.field = field
+	for _, child := range n.children {
+		child.setField(field)
+	}
+}
+
+// Text returns the words of the terms that are not excluded.
+func (n *queryNode) Text() string {
+	if n == nil || n.negated {
+		return ""
+	}
+	if n.kind == queryTerm {
+		return n.text
+	}
+	var words []string
+	for _, child := range n.children {
+		if text := child.Text(); text != "" {
+			words = append(words, text)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// QueryText returns the plain words of query, or query itself when it does not parse.
+func QueryText(query string) string {
+	node, err := QueryParse(query)
+	if err != nil {
+		return query
+	}
+	return node.Text()
+}
+
+// ftsColumns describes the field columns of an FTS5 table and its tokenizer.
+type ftsColumns struct {
+	fields  map[string]string
+	trigram bool
+}
+
+var (
+	ftsArticleColumns = map[string]string{"": "", "title": ""}
+	ftsSectionColumns = map[string]string{"": "", "section": "title", "article": "content"}
+)
+
+// compile returns the FTS5 expression of the node, ok false when it cannot match.
+func (n *queryNode) compile(c ftsColumns) (expr string, ok bool) {
+	column, ok := c.fields[n.field]
+	if !ok {
+		return "", false
+	}
+
+	switch n.kind {
+	case queryTerm:
+		if c.trigram && utf8.RuneCountInString(strings.TrimSpace(n.text)) < 3 {
+			return "", true
+		}
+		return ftsColumn(column, ftsPhrase(n.text)), true
+
+	case queryNear:
+		var phrases []string
+		for _, child := range n.children {
+			if !c.trigram || utf8.RuneCountInString(strings.TrimSpace(child.text)) >= 3 {
+				phrases = append(phrases, ftsPhrase(child.text))
+			}
+		}
+		if len(phrases) == 0 {
+			return "", true
+		}
+		return ftsColumn(column, fmt.Sprintf("NEAR(%s, %d)", strings.Join(phrases, " "), n.distance)), true
+
+	case queryOr:
+		var alternatives []string
+		for _, child := range n.children {
+			expr, ok := child.compile(c)
+			if !ok {
+				continue
+			}
+			if expr == "" {
+				return "", true
+			}
+			alternatives = append(alternatives, expr)
+		}
+		if len(alternatives) == 0 {
+			return "", false
+		}
+		if len(alternatives) == 1 {
+			return alternatives[0], true
+		}
+		return "(" + strings.Join(alternatives, " OR ") + ")", true
+
+	case queryAnd:
+		var included, excluded []string
+		for _, child := range n.children {
+			expr, ok := child.compile(c)
+			if child.negated {
+				if ok && expr != "" {
+					excluded = append(excluded, expr)
+				}
+				continue
+			}
+			if !ok {
+				return "", false
+			}
+			if expr != "" {
+				included = append(included, expr)
+			}
+		}
+		if len(included) == 0 {
+			return "", true
+		}
+		expr := "(" + strings.Join(included, " AND ") + ")"
+		if len(excluded) == 0 {
+			return expr, true
+		}
+		for _, item := range excluded {
+			expr += " NOT " + item
+		}
+		return "(" + expr + ")", true
+	}
+
+	return "", false
+}
+
+func ftsPhrase(text string) string {
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+}
+
+func ftsColumn(column string, expr string) string {
+	if column == "" {
+		return expr
+	}
+	return column + " : " + expr
+}
+
+// ftsMatch compiles node into an FTS5 MATCH expression, empty when it cannot match.
+func ftsMatch(node *queryNode, fields map[string]string, tokenizer string) string {
+	if node == nil || node.negated {
+		return ""
+	}
+	expr, ok := node.compile(ftsColumns{fields: fields, trigram: tokenizer == "trigram"})
+	if ok && expr == "" {
+		expr, ok = node.compile(ftsColumns{fields: fields})
+	}
+	if !ok {
+		return ""
+	}
+	return expr
+}
+
+// ftsTitleFilter splits the top level article title terms out of node.
+func ftsTitleFilter(node *queryNode) (rest *queryNode, include *queryNode, exclude *queryNode) {
+	if node == nil {
+		return nil, nil, nil
+	}
+	children := []*queryNode{node}
+	if node.kind == queryAnd && node.field == "" {
+		children = node.children
+	}
+
+	var others, included, excluded []*queryNode
+	for _, child := range children {
+		switch {
+		case child.field != "title":
+			others = append(others, child)
+		case child.negated:
+			positive := *child
+			positive.negated = false
+			excluded = append(excluded, &positive)
+		default:
+			included = append(included, child)
+		}
+	}
+
+	group := func(kind int, nodes []*queryNode) *queryNode {
+		switch len(nodes) {
+		case 0:
+			return nil
+		case 1:
+			return nodes[0]
+		}
+		return &queryNode{kind: kind, children: nodes}
+	}
+	rest = group(queryAnd, others)
+	if rest != nil && rest.negated {
+		rest = nil
+	}
+	if rest != nil && rest.kind == queryAnd {
+		included := false
+		for _, child := range rest.children {
+			included = included || !child.negated
+		}
+		if !included {
+			rest = nil
+		}
+	}
+	return rest, group(queryAnd, included), group(queryOr, excluded)
+}
@@ -0,0 +1,163 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{`"linux kernel`, "missing closing quote"},
+		{`a"b`, "missing closing quote"},
+		{`(linux`, "missing closing parenthesis"},
+		{`-linux`, "at least one term must not be excluded"},
+		{`-linux -"free software"`, "at least one term must not be excluded"},
+		{`linux OR`, "OR without a term after it"},
+		{`NEAR(linux)`, "NEAR needs at least two terms"},
+	}
+
+	for _, test := range tests {
+		_, err := QueryParse(test.query)
+		if err == nil {
+			t.Errorf("QueryParse(%q): no error, want %q", test.query, test.err)
+			continue
+		}
+		if !IsQuerySyntaxError(err) || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("QueryParse(%q): error %q, want a syntax error with %q", test.query, err, test.err)
+		}
+	}
+}
+
+func TestFTSMatch(t *testing.T) {
+	tests := []struct {
+		query     string
+		tokenizer string
+		article   string
+		section   string
+	}{
+		{`linux kernel`, "", `("linux" AND "kernel")`, `("linux" AND "kernel")`},
+		{`"linux kernel"`, "", `"linux kernel"`, `"linux kernel"`},
+		{`linux -kernel`, "", `(("linux") NOT "kernel")`, `(("linux") NOT "kernel")`},
+		{`linux -"free software"`, "", `(("linux") NOT "free software")`, `(("linux") NOT "free software")`},
+		{`x -(a -b)`, "", `(("x") NOT (("a") NOT "b"))`, `(("x") NOT (("a") NOT "b"))`},
+		{`linux -kernel OR unix`, "", `((("linux") NOT "kernel") OR "unix")`, `((("linux") NOT "kernel") OR "unix")`},
+		{`linux OR unix`, "", `("linux" OR "unix")`, `("linux" OR "unix")`},
+		{`linux OR bsd kernel`, "", `("linux" OR ("bsd" AND "kernel"))`, `("linux" OR ("bsd" AND "kernel"))`},
+		{`(linux OR bsd) kernel`, "", `(("linux" OR "bsd") AND "kernel")`, `(("linux" OR "bsd") AND "kernel")`},
+		{`linux or unix`, "", `("linux" AND "or" AND "unix")`, `("linux" AND "or" AND "unix")`},
+		{`NEAR(linux kernel, 5)`, "", `NEAR("linux" "kernel", 5)`, `NEAR("linux" "kernel", 5)`},
+		{`NEAR(linux kernel)`, "", `NEAR("linux" "kernel", 10)`, `NEAR("linux" "kernel", 10)`},
+		{`near(linux kernel)`, "", `("near" AND ("linux" AND "kernel"))`, `("near" AND ("linux" AND "kernel"))`},
+		{`title:linux`, "", `"linux"`, ``},
+		{`title:linux kernel`, "", `("linux" AND "kernel")`, ``},
+		{`section:history linux`, "", ``, `(title : "history" AND "linux")`},
+		{`article:"free software"`, "", ``, `content : "free software"`},
+		{`Section:(history OR origins)`, "", ``, `(title : "history" OR title : "origins")`},
+		{`article:NEAR(linux kernel, 3)`, "", ``, `content : NEAR("linux" "kernel", 3)`},
+		{`history OR section:origins`, "", `"history"`, `("history" OR title : "origins")`},
+		{`linux -section:history`, "", `("linux")`, `(("linux") NOT title : "history")`},
+		{`bogus:linux`, "", `"bogus:linux"`, `"bogus:linux"`},
+		{`c++ OR c#`, "", `("c++" OR "c#")`, `("c++" OR "c#")`},
+		{`AT&T`, "", `"AT&T"`, `"AT&T"`},
+		{`go is fun`, "trigram", `("fun")`, `("fun")`},
+		{`go is`, "trigram", `("go" AND "is")`, `("go" AND "is")`},
+		{`ab -cd linux`, "trigram", `("linux")`, `("linux")`},
+		{`NEAR(go rust, 3)`, "trigram", `NEAR("rust", 3)`, `NEAR("rust", 3)`},
+		{`go OR rust`, "trigram", `("go" OR "rust")`, `("go" OR "rust")`},
+		{`""`, "", ``, ``},
+	}
+
+	for _, test := range tests {
+		node, err := QueryParse(test.query)
+		if err != nil {
+			t.Errorf("QueryParse(%q): %v", test.query, err)
+			continue
+		}
+		if got := ftsMatch(node, ftsArticleColumns, test.tokenizer); got != test.article {
+			t.Errorf("ftsMatch(%q, articles, %q) = %s, want %s", test.query, test.tokenizer, got, test.article)
+		}
+		if got := ftsMatch(node, ftsSectionColumns, test.tokenizer); got != test.section {
+			t.Errorf("ftsMatch(%q, sections, %q) = %s, want %s", test.query, test.tokenizer, got, test.section)
+		}
+	}
+}
+
+func TestFTSPhrase(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`linux`, `"linux"`},
+		{`free software`, `"free software"`},
+		{`say "hi"`, `"say ""hi"""`},
+		{`"`, `""""`},
+		{`NEAR(a b)`, `"NEAR(a b)"`},
+	}
+
+	for _, test := range tests {
+		if got := ftsPhrase(test.text); got != test.want {
+			t.Errorf("ftsPhrase(%q) = %s, want %s", test.text, got, test.want)
+		}
+	}
+}
+
+func TestFTSTitleFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		rest    string
+		include string
+		exclude string
+	}{
+		{`linux kernel`, `("linux" AND "kernel")`, ``, ``},
+		{`title:linux`, ``, `"linux"`, ``},
+		{`title:linux kernel`, `"kernel"`, `"linux"`, ``},
+		{`title:linux -title:unix kernel`, `"kernel"`, `"linux"`, `"unix"`},
+		{`title:linux title:kernel history`, `"history"`, `("linux" AND "kernel")`, ``},
+		{`title:(linux OR unix) section:history`, `title : "history"`, `("linux" OR "unix")`, ``},
+		// A title alternative cannot filter the sections, the title search
+		// finds those articles.
+		{`title:linux OR kernel`, `"kernel"`, ``, ``},
+	}
+
+	for _, test := range tests {
+		node, err := QueryParse(test.query)
+		if err != nil {
+			t.Errorf("QueryParse(%q): %v", test.query, err)
+			continue
+		}
+		rest, include, exclude := ftsTitleFilter(node)
+		if got := ftsMatch(rest, ftsSectionColumns, ""); got != test.rest {
+			t.Errorf("ftsTitleFilter(%q) rest = %s, want %s", test.query, got, test.rest)
+		}
+		if got := ftsMatch(include, ftsArticleColumns, ""); got != test.include {
+			t.Errorf("ftsTitleFilter(%q) include = %s, want %s", test.query, got, test.include)
+		}
+		if got := ftsMatch(exclude, ftsArticleColumns, ""); got != test.exclude {
+			t.Errorf("ftsTitleFilter(%q) exclude = %s, want %s", test.query, got, test.exclude)
+		}
+	}
+}
+
+func TestQueryText(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`linux kernel`, `linux kernel`},
+		{`"linux kernel" -windows`, `linux kernel`},
+		{`title:linux OR section:history`, `linux history`},
+		{`NEAR(linux kernel, 5)`, `linux kernel`},
+		{`"linux`, `"linux`},
+	}
+
+	for _, test := range tests {
+		if got := QueryText(test.query); got != test.want {
+			t.Errorf("QueryText(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
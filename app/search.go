@@ -4,82 +4,316 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
-func Search(query string, limit int) ([]SearchResult, error) {
+const (
+	SearchFuzzyTitles        = 3
+	SearchCorrectionResults  = 3
+	SearchCorrectionTerms    = 5
+	SearchCorrectionMinRunes = 4
+	SearchMaxLimit           = 100
+	SearchMaxOffset          = 1000
+	SearchRelatedArticles    = 10
+	SearchRelatedSections    = 5
+)
+
+// SearchContext derives the context of a search request from parent,
+// bounded by the requested timeout in seconds or by -search-timeout,
+// whichever is shorter.
+func SearchContext(parent context.Context, seconds float64) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(options.searchTimeout) * time.Second
+	if requested := time.Duration(seconds * float64(time.Second)); requested > 0 && (timeout == 0 || requested < timeout) {
+		timeout = requested
+	}
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// SearchFunc is a search returning up to limit results ranked with
+// settings, and the corrected query when it searched one.
+type SearchFunc func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, string, error)
+
+// SearchPageCheck returns an error when a page starts beyond
+// SearchMaxOffset or holds more results than SearchMaxLimit, or -limit when
+// larger, since every page ranks all the results before it.
+func SearchPageCheck(offset, limit int) error {
+	if offset < 0 || limit <= 0 {
+		return fmt.Errorf("invalid offset or limit parameter")
+	}
+	if maxLimit := max(SearchMaxLimit, options.limit); limit > maxLimit {
+		return fmt.Errorf("limit parameter above %d", maxLimit)
+	}
+	if offset > SearchMaxOffset {
+		return fmt.Errorf("offset parameter above %d", SearchMaxOffset)
+	}
+	return nil
+}
+
+// SearchPage runs searchFunc for the results from offset to offset+limit and
+// one more, which reports whether more results follow the page.
+func SearchPage(ctx context.Context, searchFunc SearchFunc, query string, settings SearchSettings, offset, limit int) ([]SearchResult, string, bool, error) {
+	if err := SearchPageCheck(offset, limit); err != nil {
+		return nil, "", false, err
+	}
+	results, suggestion, err := searchFunc(ctx, query, settings, offset+limit+1)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	hasMore := len(results) > offset+limit
+	results = results[min(offset, len(results)):min(offset+limit, len(results))]
+	return results, suggestion, hasMore, nil
+}
+
+// searchUnranked adapts the searches that return the results of a single
+// engine, and so ignore the fusion settings, to the ones taking them.
+func searchUnranked(searchFunc func(ctx context.Context, query string, limit int) ([]SearchResult, error)) func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error) {
+	return func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error) {
+		return searchFunc(ctx, query, limit)
+	}
+}
+
+// SearchCursor returns an opaque reference to the page at offset, bound to
+// the query and to the page size. It is not a snapshot, the pages shift when
+// the database changes between requests.
+func SearchCursor(query string, offset, limit int) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%08x", offset, limit, hash.Sum32())))
+}
+
+// SearchCursorParse returns the offset and page size stored in cursor.
+func SearchCursorParse(cursor string, query string) (offset int, limit int, err error) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		_, err = fmt.Sscanf(string(value), "%d:%d:", &offset, &limit)
+	}
+	if err != nil || offset < 0 || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	if SearchCursor(query, offset, limit) != cursor {
+		return 0, 0, fmt.Errorf("cursor does not match the query")
+	}
+	return offset, limit, nil
+}
+
+func Search(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error) {
+	results, _, err := SearchSuggest(ctx, query, settings, limit)
+	return results, err
+}
+
+// SearchSuggest runs the combined search and, when the lexical results are
+// poor, retries it with a spelling corrected query returned as suggestion.
+func SearchSuggest(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, string, error) {
 	start := time.Now()
 	var results []SearchResult
+	var suggestion string
 
-	lexical, err := SearchLexical(query, limit)
+	lexical, err := searchLexical(ctx, query, limit)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	if searchRefs(lexical) < SearchCorrectionResults {
+		correctionStart := time.Now()
+		corrected, err := SearchCorrection(ctx, query)
+		if err != nil {
+			return nil, "", err
+		}
+		corrections := 0
+		if corrected != "" {
+			corrections = 1
+		}
+		searchStage(ctx, "correction", "", correctionStart, corrections)
+		if corrected != "" {
+			correctedLexical, err := searchLexical(ctx, corrected, limit)
+			if err != nil {
+				return nil, "", err
+			}
+			if searchRefs(correctedLexical) > searchRefs(lexical) {
+				query = corrected
+				lexical = correctedLexical
+				suggestion = corrected
+			}
+		}
 	}
 	results = append(results, lexical...)
 
-	if len(lexical) <= limit {
-		semantic, err := SearchSemantic(query, limit)
+	text := QueryText(query)
+	titles := 0
+	for _, result := range lexical {
+		if result.Type == "T" {
+			titles++
+		}
+	}
+	if titles < SearchFuzzyTitles && settings.Weights["fuzzy"] > 0 && text != "" {
+		fuzzy, err := searchTitleFuzzy(ctx, text, limit)
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		results = append(results, fuzzy...)
+	}
+
+	if settings.Weights["semantic"] > 0 && text != "" {
+		semantic, err := SearchSemantic(ctx, text, limit)
+		if err != nil {
+			return nil, "", err
 		}
 		results = append(results, semantic...)
 	}
 
-	res := searchOptimize(results, limit)
+	res := searchFuse(ctx, results, settings, max(limit, options.aiRerankTop))
+	if settings.Rerank {
+		res, err = aiRerank(ctx, query, res, options.aiRerankTop)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if len(res) > limit {
+		res = res[:limit]
+	}
 
 	if options.log {
 		log.Printf("Search: %q took %v", query, time.Since(start))
 	}
 
-	return res, nil
+	return res, suggestion, nil
+}
+
+// SearchCorrection replaces the query words missing from the vocabulary with
+// the closest and most frequent known term of the databases with the
+// vocabulary index, it returns an empty string when nothing was corrected.
+// Operators, phrases, excluded and field terms are left untouched.
+func SearchCorrection(ctx context.Context, query string) (string, error) {
+	words := strings.Fields(query)
+	corrected := false
+
+	for i, word := range words {
+		if word == "OR" || strings.HasPrefix(word, "-") || strings.ContainsAny(word, `:"(),`) {
+			continue
+		}
+		normalized := TextNormalize(word)
+		length := utf8.RuneCountInString(normalized)
+		if length < SearchCorrectionMinRunes {
+			continue
+		}
+		maxDistance := 1
+		if length > 5 {
+			maxDistance = 2
+		}
+
+		var best *vocabularyMatch
+		frequencies := make(map[string]int64)
+		var candidates []vocabularyMatch
+		for _, h := range federatedHandlers() {
+			if h.vocabularyIndex != vocabularyIndexVersion {
+				continue
+			}
+			matches, err := h.vocabularyMatches(ctx, normalized, SearchCorrectionTerms)
+			if err != nil {
+				return "", err
+			}
+			for _, match := range matches {
+				frequencies[match.term] += match.frequency
+			}
+			candidates = append(candidates, matches...)
+		}
+		for i, candidate := range candidates {
+			if best == nil || candidate.distance < best.distance || candidate.distance == best.distance && frequencies[candidate.term] > frequencies[best.term] {
+				best = &candidates[i]
+			}
+		}
+		if best == nil || best.distance == 0 || best.distance > maxDistance {
+			continue
+		}
+		words[i] = best.term
+		corrected = true
+	}
+
+	if !corrected {
+		return "", nil
+	}
+	return strings.Join(words, " "), nil
 }
 
-func SearchSemantic(query string, limit int) ([]SearchResult, error) {
+func SearchSemantic(ctx context.Context, query string, limit int) ([]SearchResult, error) {
 	var results []SearchResult
 
 	if ai {
-		vectors, err := db.SearchVectors(query, limit)
+		start := time.Now()
+		queryEmbedding, err := aiQueryEmbeddings(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		searchStage(ctx, "embedding", "", start, 1)
+		vectors, err := federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+			if h.model != "" && h.model != options.aiModel {
+				return nil, nil
+			}
+			return h.SearchEmbedding(ctx, queryEmbedding, limit)
+		})
 		if err != nil {
 			return nil, err
 		}
 		for _, vector := range vectors {
 			results = append(results, vector)
 		}
+		start = time.Now()
+		if err := SearchPassages(ctx, query, queryEmbedding, results); err != nil {
+			return nil, err
+		}
+		searchStage(ctx, "passages", "", start, len(results))
 	}
 
 	return results, nil
 }
 
-func SearchLexical(query string, limit int) ([]SearchResult, error) {
-	var results []SearchResult
-	var err error
-
-	results, err = SearchTitle(query, limit)
+func SearchLexical(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error) {
+	results, err := searchLexical(ctx, query, limit)
 	if err != nil {
 		return nil, err
 	}
 
-	contents, err := db.SearchContent(query, limit)
+	return searchFuse(ctx, results, settings, limit), nil
+}
+
+func searchLexical(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	results, err := SearchTitle(ctx, query, limit)
 	if err != nil {
 		return nil, err
 	}
-	for _, content := range contents {
-		results = append(results, content)
+
+	contents, err := federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+		return h.SearchContent(ctx, query, limit)
+	})
+	if err != nil {
+		return nil, err
 	}
+	results = append(results, contents...)
 
-	return searchOptimize(results, limit), nil
+	return results, nil
 }
 
-func SearchTitle(query string, limit int) ([]SearchResult, error) {
+func SearchTitle(ctx context.Context, query string, limit int) ([]SearchResult, error) {
 	var results []SearchResult
 
-	titles, err := db.SearchTitle(query, limit)
+	titles, err := federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+		return h.SearchTitle(ctx, query, limit)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -90,13 +324,187 @@ func SearchTitle(query string, limit int) ([]SearchResult, error) {
 	return results, nil
 }
 
-func SearchWordDistance(word string, limit int) ([]SearchResult, error) {
-	return db.SearchWordDistance(word, limit)
+func SearchTitleFuzzy(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error) {
+	results, err := searchTitleFuzzy(ctx, QueryText(query), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return searchFuse(ctx, results, settings, limit), nil
+}
+
+func searchTitleFuzzy(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	return federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+		return h.SearchTitleFuzzy(ctx, query, limit)
+	})
+}
+
+func SearchWordDistance(ctx context.Context, word string, limit int) ([]SearchResult, error) {
+	results, err := federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+		return h.SearchWordDistance(ctx, word, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(federatedHandlers()) > 1 {
+		seen := make(map[string]bool)
+		words := []SearchResult{}
+		for _, result := range results {
+			if !seen[result.Text] {
+				seen[result.Text] = true
+				result.Source = ""
+				words = append(words, result)
+			}
+		}
+		sort.SliceStable(words, func(i, j int) bool {
+			return words[i].Power < words[j].Power
+		})
+		if len(words) > limit {
+			words = words[:limit]
+		}
+		results = words
+	}
+
+	return results, nil
+}
+
+// Suggest completes prefix with the matching titles, followed by the last
+// word completed with the most frequent vocabulary terms, at most limit of
+// each.
+func Suggest(ctx context.Context, prefix string, limit int) ([]Suggestion, error) {
+	prefix = strings.TrimLeft(prefix, " ")
+	fields := strings.Fields(prefix)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	head := strings.TrimSuffix(prefix, fields[len(fields)-1])
+	handlers := federatedHandlers()
+
+	var titles, terms []Suggestion
+	frequencies := make(map[string]int)
+	for _, h := range handlers {
+		found, err := h.SuggestTitles(ctx, prefix, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, title := range found {
+			if len(handlers) > 1 {
+				title.Source = h.name
+			}
+			titles = append(titles, title)
+		}
+
+		if strings.HasSuffix(prefix, " ") {
+			continue
+		}
+		found, err = h.SuggestTerms(ctx, fields[len(fields)-1], limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, term := range found {
+			term.Text = head + term.Text
+			if i, ok := frequencies[term.Text]; ok {
+				terms[i].Popularity += term.Popularity
+				continue
+			}
+			frequencies[term.Text] = len(terms)
+			terms = append(terms, term)
+		}
+	}
+
+	suggestSort(titles)
+	suggestSort(terms)
+	if len(titles) > limit {
+		titles = titles[:limit]
+	}
+	if len(terms) > limit {
+		terms = terms[:limit]
+	}
+	return append(titles, terms...), nil
+}
+
+// SearchRelated returns the articles nearest to the one at ref: its section
+// embeddings are pooled, by mean or max, into one query searched in the
+// vectors, or ANN index, of the databases sharing its model. The article
+// itself is left out and every other article appears once, with its closest
+// section.
+func SearchRelated(ctx context.Context, ref string, limit int, pool string) ([]SearchResult, error) {
+	if pool == "" {
+		pool = "mean"
+	}
+	if pool != "mean" && pool != "max" {
+		return nil, fmt.Errorf("unsupported pooling: %q", pool)
+	}
+
+	source, id, err := ArticleRefParse(ref)
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := source.ArticleEmbeddings(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) == 0 {
+		return nil, nil
+	}
+
+	size := len(embeddings[0])
+	for _, embedding := range embeddings {
+		size = min(size, len(embedding))
+	}
+	query := make([]float32, size)
+	for i := range query {
+		query[i] = embeddings[0][i]
+		for _, embedding := range embeddings[1:] {
+			if pool == "max" {
+				query[i] = max(query[i], embedding[i])
+			} else {
+				query[i] += embedding[i]
+			}
+		}
+	}
+	l2Norm(query)
+
+	candidates := limit*SearchRelatedSections + len(embeddings)
+	sections, err := federatedSearch(func(h *DBHandler) ([]SearchResult, error) {
+		annSize := h.annSize
+		if annSize == 0 {
+			annSize = options.aiAnnSize
+		}
+		if h.model != source.model || (h.AiHasANN() && annSize > size) {
+			return nil, nil
+		}
+		return h.SearchEmbedding(ctx, query, candidates)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].Power > sections[j].Power
+	})
+	self := ArticleRef(source.name, id)
+	seen := map[string]bool{self: true}
+	var results []SearchResult
+	for _, section := range sections {
+		if seen[section.Ref()] {
+			continue
+		}
+		seen[section.Ref()] = true
+		results = append(results, section)
+		if len(results) == limit {
+			break
+		}
+	}
+
+	return results, nil
 }
 
 func SearchCli() error {
 	reader := bufio.NewReader(os.Stdin)
-	articles := make(map[int]int)
+	articles := make(map[int]string)
+	explain := false
 
 	for {
 		fmt.Print("> ")
@@ -105,11 +513,16 @@ func SearchCli() error {
 		if query == "" {
 			return nil
 		}
+		if query == ":explain" {
+			explain = !explain
+			fmt.Printf("Explain: %v\n", explain)
+			continue
+		}
 
 		queryIdx, err := strconv.Atoi(query)
 		if err == nil {
-			if articleID, exists := articles[queryIdx]; exists {
-				article, err := db.ArticleGet(articleID)
+			if ref, exists := articles[queryIdx]; exists {
+				article, err := ArticleGet(context.Background(), ref)
 				if err != nil {
 					log.Fatal("CLI error: ", err)
 				}
@@ -129,51 +542,61 @@ func SearchCli() error {
 		}
 
 		if query != "" {
-			results, err := Search(query, options.limit)
+			ctx, cancel := SearchContext(context.Background(), 0)
+			ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+			if explain {
+				ctx = WithSearchTrace(ctx)
+			}
+			results, suggestion, _, err := SearchPage(ctx, SearchSuggest, query, SearchSettingsDefault(), 0, options.limit)
+			ctxErr := ctx.Err()
+			stop()
+			cancel()
 			if err != nil {
+				if ctxErr != nil {
+					fmt.Printf("Search stopped: %v\n", ctxErr)
+					continue
+				}
+				if IsQuerySyntaxError(err) {
+					fmt.Println(err)
+					continue
+				}
 				log.Fatal("CLI error: ", err)
 			}
+			if suggestion != "" {
+				fmt.Printf("Did you mean: %s\n", suggestion)
+			}
 
-			articles = make(map[int]int)
+			articles = make(map[int]string)
 			for i, result := range results {
-				articles[i+1] = result.ArticleID
-				if options.log {
-					fmt.Printf("% 3d [%s] [%.0f] %s\n", i+1, result.Type, result.Power, result.Title)
+				articles[i+1] = result.Ref()
+				title := result.Title
+				if result.Source != "" {
+					title = result.Source + ": " + title
+				}
+				if options.log || explain {
+					fmt.Printf("% 3d [%s] [%.0f] %s\n", i+1, result.Type, result.Power, title)
 				} else {
-					fmt.Printf("% 3d [%s] %s\n", i+1, result.Type, result.Title)
+					fmt.Printf("% 3d [%s] %s\n", i+1, result.Type, title)
+				}
+				if result.Explain != nil {
+					fmt.Printf("\033[1;30m     %s\n\033[0m", result.Explain)
 				}
 			}
-		}
-	}
-}
-
-func searchOptimize(results []SearchResult, limit int) []SearchResult {
-	seen := make(map[int]bool)
-	accumulatedResults := []SearchResult{}
-
-	for _, result := range results {
-		if !seen[result.ArticleID] {
-			seen[result.ArticleID] = true
-			accumulatedResults = append(accumulatedResults, result)
-		} else {
-			for i := range accumulatedResults {
-				if accumulatedResults[i].ArticleID == result.ArticleID {
-					p1 := accumulatedResults[i].Power
-					p2 := result.Power
-					accumulatedResults[i].Power = p1 + p2 - (p1 * p2 / 100.0)
-					break
+			for _, timing := range SearchTimings(ctx) {
+				stage := timing.Stage
+				if timing.Source != "" {
+					stage += " " + timing.Source
 				}
+				fmt.Printf("\033[1;30m     %s: %d results (%.3fs)\n\033[0m", stage, timing.Results, timing.Time)
 			}
 		}
 	}
+}
 
-	sort.Slice(accumulatedResults, func(i, j int) bool {
-		return accumulatedResults[i].Power > accumulatedResults[j].Power
-	})
-
-	if len(accumulatedResults) > limit {
-		accumulatedResults = accumulatedResults[:limit]
+func searchRefs(results []SearchResult) int {
+	refs := make(map[string]bool)
+	for _, result := range results {
+		refs[result.Ref()] = true
 	}
-
-	return accumulatedResults
+	return len(refs)
 }
@@ -0,0 +1,62 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSearchPage(t *testing.T) {
+	if options == nil {
+		options = &Config{limit: 10}
+	}
+	total := 25
+	var depths []int
+	searchFunc := func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, string, error) {
+		depths = append(depths, limit)
+		var results []SearchResult
+		for id := 1; id <= min(limit, total); id++ {
+			results = append(results, SearchResult{ArticleID: id})
+		}
+		return results, "", nil
+	}
+
+	tests := []struct {
+		offset, limit int
+		first, count  int
+		hasMore       bool
+		depth         int
+	}{
+		{0, 10, 1, 10, true, 11},
+		{10, 10, 11, 10, true, 21},
+		{20, 10, 21, 5, false, 31},
+		{15, 10, 16, 10, false, 26},
+		{30, 10, 0, 0, false, 41},
+	}
+
+	for _, test := range tests {
+		depths = nil
+		results, _, hasMore, err := SearchPage(context.Background(), searchFunc, "query", SearchSettings{}, test.offset, test.limit)
+		if err != nil {
+			t.Errorf("SearchPage(%d, %d): %v", test.offset, test.limit, err)
+			continue
+		}
+		if len(results) != test.count || hasMore != test.hasMore {
+			t.Errorf("SearchPage(%d, %d) = %d results, has more %v, want %d, %v", test.offset, test.limit, len(results), hasMore, test.count, test.hasMore)
+		}
+		if len(results) > 0 && results[0].ArticleID != test.first {
+			t.Errorf("SearchPage(%d, %d) starts at %d, want %d", test.offset, test.limit, results[0].ArticleID, test.first)
+		}
+		if len(depths) != 1 || depths[0] != test.depth {
+			t.Errorf("SearchPage(%d, %d) searched %v results, want %d", test.offset, test.limit, depths, test.depth)
+		}
+	}
+
+	for _, page := range [][2]int{{-1, 10}, {0, 0}, {0, SearchMaxLimit + 1}, {SearchMaxOffset + 1, 10}} {
+		depths = nil
+		if _, _, _, err := SearchPage(context.Background(), searchFunc, "query", SearchSettings{}, page[0], page[1]); err == nil || depths != nil {
+			t.Errorf("SearchPage(%d, %d) searched, want an error", page[0], page[1])
+		}
+	}
+}
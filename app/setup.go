@@ -189,6 +189,9 @@ func Setup() {
 	}
 
 	selectedGroup := fileGroups[groupKeys[choice-1]]
+	sort.Slice(selectedGroup, func(i, j int) bool {
+		return selectedGroup[i].Rfilename < selectedGroup[j].Rfilename
+	})
 
 	if _, err := os.Stat(options.dbPath); err == nil {
 		fmt.Println("A db already exists, please remove it and try again.")
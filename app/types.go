@@ -3,12 +3,57 @@
 package main
 
 type SearchResult struct {
-	ArticleID int     `json:"article_id,omitempty"`
-	Title     string  `json:"title,omitempty"`
-	Text      string  `json:"text"`
-	Type      string  `json:"type,omitempty"`
-	Power     float64 `json:"power"`
-	Snippet   string  `json:"snippet"`
+	ArticleID    int            `json:"article_id,omitempty"`
+	SectionID    int            `json:"section_id,omitempty"`
+	Source       string         `json:"source,omitempty"`
+	Title        string         `json:"title,omitempty"`
+	SectionTitle string         `json:"section_title,omitempty"`
+	Text         string         `json:"text"`
+	Type         string         `json:"type,omitempty"`
+	Power        float64        `json:"power"`
+	Snippet      string         `json:"snippet"`
+	Highlights   [][2]int       `json:"highlights,omitempty"`
+	Explain      *SearchExplain `json:"explain,omitempty"`
+}
+
+type SearchExplainAnn struct {
+	Centroid   int     `json:"centroid,omitempty"`
+	Rank       int     `json:"rank"`
+	Similarity float64 `json:"similarity"`
+	Candidates int     `json:"candidates"`
+}
+
+type SearchExplainFusion struct {
+	Engine       string  `json:"engine"`
+	Rank         int     `json:"rank"`
+	Power        float64 `json:"power"`
+	Weight       float64 `json:"weight"`
+	Contribution float64 `json:"contribution"`
+}
+
+type SearchExplain struct {
+	BM25    map[string]float64    `json:"bm25,omitempty"`
+	Trigram *float64              `json:"trigram,omitempty"`
+	Cosine  *float64              `json:"cosine,omitempty"`
+	Ann     *SearchExplainAnn     `json:"ann,omitempty"`
+	Fusion  []SearchExplainFusion `json:"fusion,omitempty"`
+	Rerank  *float64              `json:"rerank,omitempty"`
+}
+
+type SearchTiming struct {
+	Stage   string  `json:"stage"`
+	Source  string  `json:"source,omitempty"`
+	Results int     `json:"results"`
+	Time    float64 `json:"time"`
+}
+
+type Suggestion struct {
+	Text       string `json:"text"`
+	Type       string `json:"type"`
+	ArticleID  int    `json:"article_id,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Popularity int64  `json:"popularity"`
+	starts     bool
 }
 
 type ArticleResultSection struct {
@@ -19,6 +64,7 @@ type ArticleResultSection struct {
 
 type ArticleResult struct {
 	ID       int                    `json:"id"`
+	Source   string                 `json:"source,omitempty"`
 	Title    string                 `json:"title,omitempty"`
 	Entity   string                 `json:"entity,omitempty"`
 	Sections []ArticleResultSection `json:"sections,omitempty"`
@@ -46,5 +92,32 @@ type VectorDistance struct {
 	ID            int64
 	ChunkRowID    int64
 	ChunkPosition int
+	Centroid      int
 	Distance      float32
 }
+
+type DBStatsTable struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type DBStats struct {
+	Source             string            `json:"source,omitempty"`
+	Size               int64             `json:"size"`
+	Articles           int               `json:"articles"`
+	Sections           int               `json:"sections"`
+	Vocabulary         int               `json:"vocabulary"`
+	Compressed         bool              `json:"compressed"`
+	CompressedSections int               `json:"compressed_sections"`
+	Vectors            int               `json:"vectors"`
+	Passages           int               `json:"passages,omitempty"`
+	VectorSize         int               `json:"vector_size"`
+	AnnSize            int               `json:"ann_size"`
+	AnnVectors         int               `json:"ann_vectors"`
+	Centroids          int               `json:"centroids"`
+	ClusterSize        float64           `json:"cluster_size"`
+	Model              string            `json:"model,omitempty"`
+	ModelSize          int64             `json:"model_size"`
+	Setup              map[string]string `json:"setup"`
+	Tables             []DBStatsTable    `json:"tables,omitempty"`
+}
@@ -14,12 +14,49 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 //go:embed assets
 var assets embed.FS
 
+// textFold maps the letters that have no canonical decomposition to their
+// base letters.
+var textFold = map[rune]string{
+	'đ': "d", 'ð': "d", 'ħ': "h", 'ı': "i", 'ł': "l", 'ø': "o", 'ŧ': "t",
+	'æ': "ae", 'œ': "oe", 'ß': "ss", 'þ': "th",
+}
+
+// TextNormalize lowercases text, removes its diacritics and joins its words
+// with single spaces.
+func TextNormalize(text string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range norm.NFD.String(strings.ToLower(text)) {
+		if unicode.IsSpace(r) || r == '_' {
+			space = sb.Len() > 0
+			continue
+		}
+		if unicode.Is(unicode.Mn, r) && r != '\u3099' && r != '\u309a' {
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		if base, ok := textFold[r]; ok {
+			sb.WriteString(base)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(sb.String())
+}
+
 func extractNumberFromString(s string) int {
 	re := regexp.MustCompile(`\d+`)
 	match := re.FindString(s)
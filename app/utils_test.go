@@ -0,0 +1,30 @@
+// Copyright (C) by Ubaldo Porcheddu <ubaldo@eja.it>
+
+package main
+
+import "testing"
+
+func TestTextNormalize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Linux", "linux"},
+		{"  Free_Software  Foundation ", "free software foundation"},
+		{"Ångström", "angstrom"},
+		{"Łódź", "lodz"},
+		{"Straße", "strasse"},
+		{"Tiếng Việt", "tieng viet"},
+		{"Hạ Long", "ha long"},
+		{"Ελλάδα", "ελλαδα"},
+		{"Ærø", "aero"},
+		{"ガギグ", "ガギグ"},
+		{"한국어", "한국어"},
+	}
+
+	for _, test := range tests {
+		if got := TextNormalize(test.text); got != test.want {
+			t.Errorf("TextNormalize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
@@ -11,21 +14,48 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type APIRequest struct {
-	Query string `json:"query,omitempty"`
-	Limit int    `json:"limit,omitempty"`
-	ID    int    `json:"id,omitempty"`
+	Query   string             `json:"query,omitempty"`
+	Limit   int                `json:"limit,omitempty"`
+	ID      int                `json:"id,omitempty"`
+	Source  string             `json:"source,omitempty"`
+	Title   string             `json:"title,omitempty"`
+	Entity  string             `json:"entity,omitempty"`
+	IDs     []int              `json:"ids,omitempty"`
+	Refs    []string           `json:"refs,omitempty"`
+	Titles  []string           `json:"titles,omitempty"`
+	Format  string             `json:"format,omitempty"`
+	Timeout float64            `json:"timeout,omitempty"`
+	Fusion  string             `json:"fusion,omitempty"`
+	RRFK    float64            `json:"rrf_k,omitempty"`
+	Weights map[string]float64 `json:"weights,omitempty"`
+	Rerank  bool               `json:"rerank,omitempty"`
+	Offset  int                `json:"offset,omitempty"`
+	Cursor  string             `json:"cursor,omitempty"`
+	Group   string             `json:"group,omitempty"`
+	Explain bool               `json:"explain,omitempty"`
+	Prefix  string             `json:"prefix,omitempty"`
+	Pool    string             `json:"pool,omitempty"`
 }
 
 type APIResponse struct {
-	Status  string          `json:"status"`
-	Message string          `json:"message,omitempty"`
-	Results *[]SearchResult `json:"results,omitempty"`
-	Article *ArticleResult  `json:"article,omitempty"`
-	Time    float64         `json:"time"`
+	Status      string                `json:"status"`
+	Message     string                `json:"message,omitempty"`
+	Results     *[]SearchResult       `json:"results,omitempty"`
+	Suggestion  string                `json:"suggestion,omitempty"`
+	HasMore     *bool                 `json:"has_more,omitempty"`
+	NextCursor  string                `json:"next_cursor,omitempty"`
+	Article     *ArticleResult        `json:"article,omitempty"`
+	Stats       *DBStats              `json:"stats,omitempty"`
+	Databases   []DBStats             `json:"databases,omitempty"`
+	Cache       map[string]CacheStats `json:"cache,omitempty"`
+	Timings     []SearchTiming        `json:"timings,omitempty"`
+	Suggestions *[]Suggestion         `json:"suggestions,omitempty"`
+	Time        float64               `json:"time"`
 }
 
 type WebServer struct {
@@ -61,63 +91,95 @@ func (s *WebServer) executeTemplate(w http.ResponseWriter, templateName string,
 func (s *WebServer) handleHTMLSearch(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var query string
-	var limit int
+	var limit, offset int
 	var results []SearchResult
+	var suggestion string
+	var hasMore bool
 
-	if r.Method == "POST" {
-		query = r.FormValue("query")
-		limit, _ = strconv.Atoi(r.FormValue("limit"))
-	}
+	query = r.FormValue("query")
+	limit, _ = strconv.Atoi(r.FormValue("limit"))
+	offset, _ = strconv.Atoi(r.FormValue("offset"))
 
 	if limit <= 0 {
 		limit = options.limit
 	}
+	offset = max(offset, 0)
+	if err := SearchPageCheck(offset, limit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if query != "" {
-		results, err = Search(query, limit)
+		ctx, cancel := SearchContext(r.Context(), 0)
+		defer cancel()
+		results, suggestion, hasMore, err = SearchPage(ctx, SearchCached("search", SearchSuggest), query, SearchSettingsDefault(), offset, limit)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), searchErrorStatus(ctx, err))
 			return
 		}
 	}
 
 	s.executeTemplate(w, "search.html", struct {
-		Query    string
-		Limit    int
-		Results  []SearchResult
-		HasQuery bool
-		Language string
-		AI       bool
+		Query      string
+		Limit      int
+		Offset     int
+		PrevOffset int
+		NextOffset int
+		HasMore    bool
+		Results    []SearchResult
+		Suggestion string
+		HasQuery   bool
+		Language   string
+		AI         bool
 	}{
-		Query:    query,
-		Limit:    limit,
-		Results:  results,
-		HasQuery: query != "",
-		Language: options.language,
-		AI:       ai,
+		Query:      query,
+		Limit:      limit,
+		Offset:     offset,
+		PrevOffset: max(offset-limit, 0),
+		NextOffset: offset + len(results),
+		HasMore:    hasMore,
+		Results:    results,
+		Suggestion: suggestion,
+		HasQuery:   query != "",
+		Language:   options.language,
+		AI:         ai,
 	})
 }
 
 func (s *WebServer) handleHTMLArticle(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
+		ctx, cancel := SearchContext(r.Context(), 0)
+		defer cancel()
+
 		value := r.FormValue("id")
-		id, err := strconv.Atoi(value)
-		if err != nil {
+		if value == "" && (r.FormValue("title") != "" || r.FormValue("entity") != "") {
+			ref, err := ArticleFind(ctx, r.FormValue("title"), r.FormValue("entity"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			value = ref
+		}
+		if _, _, err := ArticleRefParse(value); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		result, err := db.ArticleGet(id)
+		result, err := ArticleGet(ctx, value)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), searchErrorStatus(ctx, err))
 			return
 		}
 
 		s.executeTemplate(w, "article.html", struct {
 			Language string
 			Result   ArticleResult
+			Ref      string
+			Related  int
 		}{
-			Language: options.language,
+			Language: ArticleLanguage(result),
 			Result:   result,
+			Ref:      value,
+			Related:  SearchRelatedArticles,
 		})
 	}
 }
@@ -131,11 +193,59 @@ func (s *WebServer) sendAPIError(w http.ResponseWriter, message string, statusCo
 	})
 }
 
-func (s *WebServer) handleGenericAPISearch(w http.ResponseWriter, r *http.Request, searchFunc func(query string, limit int) ([]SearchResult, error)) {
+func searchErrorStatus(ctx context.Context, err error) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	if IsQuerySyntaxError(err) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, ErrArticleNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func searchRequestSettings(request APIRequest, weights string) (SearchSettings, error) {
+	settings := SearchSettingsDefault()
+	if request.Fusion != "" {
+		settings.Fusion = request.Fusion
+	}
+	if request.RRFK != 0 {
+		settings.RRFK = request.RRFK
+	}
+	if request.Group != "" {
+		settings.Group = request.Group
+	}
+	settings.Rerank = request.Rerank
+
+	var err error
+	if settings.Weights, err = SearchWeightsParse(weights, settings.Weights); err != nil {
+		return settings, err
+	}
+	for engine, weight := range request.Weights {
+		if _, ok := SearchEngines[engine]; !ok || weight < 0 {
+			return settings, fmt.Errorf("invalid search weight: %q", engine)
+		}
+		settings.Weights[engine] = weight
+	}
+
+	return settings, settings.Validate()
+}
+
+func (s *WebServer) handleGenericAPISearch(w http.ResponseWriter, r *http.Request, endpoint string, searchFunc func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, error)) {
+	s.handleGenericAPISearchSuggest(w, r, endpoint, func(ctx context.Context, query string, settings SearchSettings, limit int) ([]SearchResult, string, error) {
+		results, err := searchFunc(ctx, query, settings, limit)
+		return results, "", err
+	})
+}
+
+func (s *WebServer) handleGenericAPISearchSuggest(w http.ResponseWriter, r *http.Request, endpoint string, searchFunc SearchFunc) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var request APIRequest
 	var query string
+	var weights string
 	var limit int = options.limit
 	var err error
 
@@ -159,6 +269,45 @@ func (s *WebServer) handleGenericAPISearch(w http.ResponseWriter, r *http.Reques
 				return
 			}
 		}
+		if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+			request.Offset, err = strconv.Atoi(offsetStr)
+			if err != nil {
+				s.sendAPIError(w, "Invalid offset parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		request.Cursor = r.URL.Query().Get("cursor")
+		if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+			request.Timeout, err = strconv.ParseFloat(timeoutStr, 64)
+			if err != nil {
+				s.sendAPIError(w, "Invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		request.Fusion = r.URL.Query().Get("fusion")
+		request.Group = r.URL.Query().Get("group")
+		if rrfKStr := r.URL.Query().Get("rrf_k"); rrfKStr != "" {
+			request.RRFK, err = strconv.ParseFloat(rrfKStr, 64)
+			if err != nil {
+				s.sendAPIError(w, "Invalid rrf_k parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		weights = r.URL.Query().Get("weights")
+		if rerankStr := r.URL.Query().Get("rerank"); rerankStr != "" {
+			request.Rerank, err = strconv.ParseBool(rerankStr)
+			if err != nil {
+				s.sendAPIError(w, "Invalid rerank parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if explainStr := r.URL.Query().Get("explain"); explainStr != "" {
+			request.Explain, err = strconv.ParseBool(explainStr)
+			if err != nil {
+				s.sendAPIError(w, "Invalid explain parameter", http.StatusBadRequest)
+				return
+			}
+		}
 	}
 	log.Printf("API %s search: %s", r.Method, query)
 
@@ -167,33 +316,73 @@ func (s *WebServer) handleGenericAPISearch(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	results, err := searchFunc(query, limit)
+	offset := request.Offset
+	if request.Cursor != "" {
+		if offset, limit, err = SearchCursorParse(request.Cursor, query); err != nil {
+			s.sendAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := SearchPageCheck(offset, limit); err != nil {
+		s.sendAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settings, err := searchRequestSettings(request, weights)
+	if err != nil {
+		s.sendAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := SearchContext(r.Context(), request.Timeout)
+	defer cancel()
+	if request.Explain {
+		ctx = WithSearchTrace(ctx)
+	}
+
+	results, suggestion, hasMore, err := SearchPage(ctx, SearchCached(endpoint, searchFunc), query, settings, offset, limit)
 	if err != nil {
-		s.sendAPIError(w, fmt.Sprintf("Search error: %v", err), http.StatusInternalServerError)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		s.sendAPIError(w, fmt.Sprintf("Search error: %v", err), searchErrorStatus(ctx, err))
 		return
 	}
 
+	var nextCursor string
+	if hasMore {
+		nextCursor = SearchCursor(query, offset+len(results), limit)
+	}
+
 	json.NewEncoder(w).Encode(APIResponse{
-		Status:  "success",
-		Results: &results,
-		Time:    time.Since(startTime).Seconds(),
+		Status:     "success",
+		Results:    &results,
+		Suggestion: suggestion,
+		HasMore:    &hasMore,
+		NextCursor: nextCursor,
+		Timings:    SearchTimings(ctx),
+		Time:       time.Since(startTime).Seconds(),
 	})
 }
 
 func (s *WebServer) handleAPISearch(w http.ResponseWriter, r *http.Request) {
-	s.handleGenericAPISearch(w, r, Search)
+	s.handleGenericAPISearchSuggest(w, r, "search", SearchSuggest)
 }
 
 func (s *WebServer) handleAPISearchTitle(w http.ResponseWriter, r *http.Request) {
-	s.handleGenericAPISearch(w, r, SearchTitle)
+	if r.URL.Query().Get("mode") == "fuzzy" {
+		s.handleGenericAPISearch(w, r, "title-fuzzy", SearchTitleFuzzy)
+		return
+	}
+	s.handleGenericAPISearch(w, r, "title", searchUnranked(SearchTitle))
 }
 
 func (s *WebServer) handleAPISearchLexical(w http.ResponseWriter, r *http.Request) {
-	s.handleGenericAPISearch(w, r, SearchLexical)
+	s.handleGenericAPISearch(w, r, "lexical", SearchLexical)
 }
 
 func (s *WebServer) handleAPISearchWordDistance(w http.ResponseWriter, r *http.Request) {
-	s.handleGenericAPISearch(w, r, SearchWordDistance)
+	s.handleGenericAPISearch(w, r, "distance", searchUnranked(SearchWordDistance))
 }
 
 func (s *WebServer) handleAPISearchSemantic(w http.ResponseWriter, r *http.Request) {
@@ -201,40 +390,166 @@ func (s *WebServer) handleAPISearchSemantic(w http.ResponseWriter, r *http.Reque
 		s.sendAPIError(w, "Semantic search is not enabled", http.StatusBadRequest)
 		return
 	}
-	s.handleGenericAPISearch(w, r, SearchSemantic)
+	s.handleGenericAPISearch(w, r, "semantic", searchUnranked(SearchSemantic))
 }
 
-func (s *WebServer) handleAPIArticle(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func (s *WebServer) handleAPISuggest(w http.ResponseWriter, r *http.Request) {
 	var request APIRequest
-	var id int
-	var err error
+	var format string
+	limit := options.limit
 
 	startTime := time.Now()
-
 	if r.Method == "POST" {
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			s.sendAPIError(w, "Invalid JSON request", http.StatusBadRequest)
 			return
 		}
-		id = request.ID
+		format = request.Format
 	} else {
-		idStr := r.URL.Query().Get("id")
-		if idStr == "" {
-			s.sendAPIError(w, "ID parameter is required", http.StatusBadRequest)
-			return
+		request.Prefix = r.URL.Query().Get("prefix")
+		format = r.URL.Query().Get("format")
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			var err error
+			if request.Limit, err = strconv.Atoi(limitStr); err != nil {
+				s.sendAPIError(w, "Invalid limit parameter", http.StatusBadRequest)
+				return
+			}
 		}
-		id, err = strconv.Atoi(idStr)
-		if err != nil {
-			s.sendAPIError(w, "Invalid ID parameter", http.StatusBadRequest)
-			return
+	}
+	if request.Limit > 0 {
+		limit = request.Limit
+	}
+	log.Printf("API %s suggest: %s", r.Method, request.Prefix)
+
+	if strings.TrimSpace(request.Prefix) == "" {
+		s.sendAPIError(w, "Prefix parameter is required", http.StatusBadRequest)
+		return
+	}
+	if format != "" && format != "json" && format != "opensearch" {
+		s.sendAPIError(w, "Invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := SearchContext(r.Context(), 0)
+	defer cancel()
+	suggestions, err := Suggest(ctx, request.Prefix, limit)
+	if err != nil {
+		s.sendAPIError(w, fmt.Sprintf("Suggest error: %v", err), searchErrorStatus(ctx, err))
+		return
+	}
+
+	if format == "opensearch" {
+		completions := []string{}
+		seen := make(map[string]bool)
+		for _, suggestion := range suggestions {
+			if key := strings.ToLower(suggestion.Text); !seen[key] {
+				seen[key] = true
+				completions = append(completions, suggestion.Text)
+			}
 		}
+		w.Header().Set("Content-Type", "application/x-suggestions+json")
+		json.NewEncoder(w).Encode([]any{request.Prefix, completions})
+		return
 	}
-	log.Printf("API %s article: %d", r.Method, id)
 
-	article, err := db.ArticleGet(id)
+	if suggestions == nil {
+		suggestions = []Suggestion{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Status:      "success",
+		Suggestions: &suggestions,
+		Time:        time.Since(startTime).Seconds(),
+	})
+}
+
+// handleOpenSearch describes the HTML search and the suggestions to the
+// browsers supporting OpenSearch.
+func (s *WebServer) handleOpenSearch(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := template.HTMLEscapeString(scheme + "://" + r.Host + "/")
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">
+  <ShortName>%s</ShortName>
+  <Description>%s %s search</Description>
+  <InputEncoding>UTF-8</InputEncoding>
+  <Url type="text/html" method="get" template="%s?query={searchTerms}"/>
+  <Url type="application/x-suggestions+json" method="get" template="%sapi/suggest?format=opensearch&amp;prefix={searchTerms}"/>
+</OpenSearchDescription>
+`, Name, Name, template.HTMLEscapeString(options.language), base, base)
+}
+
+// apiArticleRequest reads a GET or POST article request, the article is
+// given by id, optionally with source, or by title or entity. On failure the
+// error is already sent.
+func (s *WebServer) apiArticleRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (APIRequest, string, bool) {
+	var request APIRequest
+	var ref string
+
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			s.sendAPIError(w, "Invalid JSON request", http.StatusBadRequest)
+			return request, "", false
+		}
+		if request.ID > 0 {
+			ref = ArticleRef(request.Source, request.ID)
+		}
+	} else {
+		values := r.URL.Query()
+		request.Title = values.Get("title")
+		request.Entity = values.Get("entity")
+		request.Pool = values.Get("pool")
+		ref = values.Get("id")
+		if source := values.Get("source"); source != "" && ref != "" {
+			ref = source + ":" + ref
+		}
+		if limitStr := values.Get("limit"); limitStr != "" {
+			var err error
+			if request.Limit, err = strconv.Atoi(limitStr); err != nil {
+				s.sendAPIError(w, "Invalid limit parameter", http.StatusBadRequest)
+				return request, "", false
+			}
+		}
+	}
+	if ref == "" {
+		if request.Title == "" && request.Entity == "" {
+			s.sendAPIError(w, "One of id, title or entity is required", http.StatusBadRequest)
+			return request, "", false
+		}
+		var err error
+		if ref, err = ArticleFind(ctx, request.Title, request.Entity); err != nil {
+			s.sendAPIError(w, fmt.Sprintf("Error retrieving article: %v", err), http.StatusNotFound)
+			return request, "", false
+		}
+	}
+	if _, _, err := ArticleRefParse(ref); err != nil {
+		s.sendAPIError(w, "Invalid ID parameter", http.StatusBadRequest)
+		return request, "", false
+	}
+	return request, ref, true
+}
+
+func (s *WebServer) handleAPIArticle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	startTime := time.Now()
+	ctx, cancel := SearchContext(r.Context(), 0)
+	defer cancel()
+
+	_, ref, ok := s.apiArticleRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	log.Printf("API %s article: %s", r.Method, ref)
+
+	article, err := ArticleGet(ctx, ref)
 	if err != nil {
-		s.sendAPIError(w, fmt.Sprintf("Error retrieving article: %v", err), http.StatusInternalServerError)
+		s.sendAPIError(w, fmt.Sprintf("Error retrieving article: %v", err), searchErrorStatus(ctx, err))
 		return
 	}
 
@@ -245,6 +560,159 @@ func (s *WebServer) handleAPIArticle(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *WebServer) handleAPIArticleRelated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	startTime := time.Now()
+	ctx, cancel := SearchContext(r.Context(), 0)
+	defer cancel()
+
+	request, ref, ok := s.apiArticleRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	if request.Pool != "" && request.Pool != "mean" && request.Pool != "max" {
+		s.sendAPIError(w, "Invalid pool parameter", http.StatusBadRequest)
+		return
+	}
+	limit := options.limit
+	if request.Limit > 0 {
+		limit = request.Limit
+	}
+	if err := SearchPageCheck(0, limit); err != nil {
+		s.sendAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("API %s related: %s", r.Method, ref)
+
+	results, err := SearchRelated(ctx, ref, limit, request.Pool)
+	if err != nil {
+		s.sendAPIError(w, fmt.Sprintf("Error retrieving related articles: %v", err), searchErrorStatus(ctx, err))
+		return
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Status:  "success",
+		Results: &results,
+		Time:    time.Since(startTime).Seconds(),
+	})
+}
+
+func (s *WebServer) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	startTime := time.Now()
+	log.Printf("API %s stats", r.Method)
+
+	var tables bool
+	if tablesStr := r.FormValue("tables"); tablesStr != "" {
+		var err error
+		if tables, err = strconv.ParseBool(tablesStr); err != nil {
+			s.sendAPIError(w, "Invalid tables parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats, err := FederatedStats(r.Context(), tables)
+	if err != nil {
+		s.sendAPIError(w, fmt.Sprintf("Error retrieving stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := APIResponse{
+		Status: "success",
+		Stats:  &stats[0],
+		Cache:  CacheStatsGet(),
+		Time:   time.Since(startTime).Seconds(),
+	}
+	if len(stats) > 1 {
+		response.Databases = stats
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *WebServer) handleAPIExport(w http.ResponseWriter, r *http.Request) {
+	var request APIRequest
+	limit := options.limit
+
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			s.sendAPIError(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+		if request.Limit > 0 {
+			limit = request.Limit
+		}
+	} else {
+		values := r.URL.Query()
+		request.Query = values.Get("query")
+		request.Format = values.Get("format")
+		request.Titles = values["title"]
+		for _, ref := range strings.Split(values.Get("ids"), ",") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				request.Refs = append(request.Refs, ref)
+			}
+		}
+		if limitStr := values.Get("limit"); limitStr != "" {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil {
+				s.sendAPIError(w, "Invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if err := SearchPageCheck(0, limit); err != nil {
+		s.sendAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, id := range request.IDs {
+		request.Refs = append(request.Refs, ArticleRef(request.Source, id))
+	}
+	for _, ref := range request.Refs {
+		if _, _, err := ArticleRefParse(ref); err != nil {
+			s.sendAPIError(w, "Invalid ids parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	log.Printf("API %s export: %v %v %s", r.Method, request.Refs, request.Titles, request.Query)
+
+	if request.Format == "" {
+		request.Format = "md"
+	}
+	format, err := ExportFormat(request.Format, "")
+	if err != nil {
+		s.sendAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Refs) == 0 && len(request.Titles) == 0 && request.Query == "" {
+		s.sendAPIError(w, "One of ids, title or query is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := SearchContext(r.Context(), request.Timeout)
+	defer cancel()
+
+	articles, err := ExportArticles(ctx, request.Refs, request.Titles, request.Query, limit)
+	if err != nil {
+		s.sendAPIError(w, fmt.Sprintf("Export error: %v", err), searchErrorStatus(ctx, err))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := Export(&buf, format, articles); err != nil {
+		s.sendAPIError(w, fmt.Sprintf("Export error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ExportFormats[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", Name, format))
+	w.Write(buf.Bytes())
+}
+
 func (s *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
 	s.handleHTMLSearch(w, r)
 }
@@ -254,13 +722,18 @@ func (s *WebServer) Start(host string, port int) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleHome)
 	mux.HandleFunc("/article", s.handleHTMLArticle)
+	mux.HandleFunc("/opensearch.xml", s.handleOpenSearch)
 
 	mux.HandleFunc("/api/search", s.handleAPISearch)
 	mux.HandleFunc("/api/search/title", s.handleAPISearchTitle)
 	mux.HandleFunc("/api/search/lexical", s.handleAPISearchLexical)
 	mux.HandleFunc("/api/search/semantic", s.handleAPISearchSemantic)
 	mux.HandleFunc("/api/search/distance", s.handleAPISearchWordDistance)
+	mux.HandleFunc("/api/suggest", s.handleAPISuggest)
 	mux.HandleFunc("/api/article", s.handleAPIArticle)
+	mux.HandleFunc("/api/article/related", s.handleAPIArticleRelated)
+	mux.HandleFunc("/api/export", s.handleAPIExport)
+	mux.HandleFunc("/api/stats", s.handleAPIStats)
 	mux.HandleFunc("/mcp", s.handleMCP)
 
 	subFS, err := fs.Sub(assets, "assets/static")
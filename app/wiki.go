@@ -34,6 +34,9 @@ func WikiImport(path string) (err error) {
 	if err = db.Optimize(); err != nil {
 		return
 	}
+	if err = db.ProcessTokenizer(options.dbTokenizer); err != nil {
+		return
+	}
 	if err = db.ProcessTitles(); err != nil {
 		return
 	}
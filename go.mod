@@ -4,6 +4,7 @@ go 1.25.0
 
 require (
 	golang.org/x/net v0.46.0
+	golang.org/x/text v0.30.0
 	zombiezen.com/go/sqlite v1.4.2
 )
 